@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/GlazeLab/PureGamer/src/model"
 	"github.com/GlazeLab/PureGamer/src/modules/entry"
@@ -10,6 +11,7 @@ import (
 	"github.com/GlazeLab/PureGamer/src/modules/optimizer"
 	"github.com/GlazeLab/PureGamer/src/modules/pinging"
 	"github.com/GlazeLab/PureGamer/src/modules/relaying"
+	"github.com/GlazeLab/PureGamer/src/modules/session"
 	"github.com/GlazeLab/PureGamer/src/modules/superadmin"
 	"github.com/GlazeLab/PureGamer/src/node"
 	"github.com/GlazeLab/PureGamer/src/utils"
@@ -47,10 +49,15 @@ func main() {
 	}
 
 	admin.Handle(ctx)
+	err = admin.HandleProposals(ctx)
+	if err != nil {
+		panic(err)
+	}
 	optimized.Handle(ctx)
 	go optimized.RunSpeedTest(ctx)
 
-	err = entry.Listen(n, exits, optimized)
+	sessions := session.NewRegistry()
+	err = entry.Listen(n, exits, optimized, sessions)
 	if err != nil {
 		panic(err)
 	}
@@ -58,7 +65,7 @@ func main() {
 	logging.SetAllLoggers(logging.LevelInfo)
 
 	privateKeyText, err := utils.ReadText("private.key")
-	privKey, err := utils.DecodePrivate(privateKeyText)
+	privKey, err := utils.DecodeSigner(privateKeyText)
 	if err != nil {
 		panic(err)
 	}
@@ -72,16 +79,16 @@ func main() {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			err = admin.SendConfig(ctx, config, privKey)
+			id, err := admin.SendConfig(ctx, config, privKey)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
+			w.Write([]byte(id))
 			return
 		} else if r.Method == "GET" {
-			// return current config
+			// return current config, as this node understands it
 			err := json.NewEncoder(w).Encode(n.Config)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -94,6 +101,64 @@ func main() {
 			return
 		}
 	})
+	http.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			// add or revoke admin keys
+			var rotation model.KeyRotation
+			err := json.NewDecoder(r.Body).Decode(&rotation)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			id, err := admin.SendKeyRotation(ctx, rotation, privKey)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(id))
+			return
+		} else if r.Method == "GET" {
+			// list the trusted admin keys
+			err := json.NewEncoder(w).Encode(admin.Keys())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			return
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	})
+	http.HandleFunc("/proposals", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			// list the proposals waiting for co-signatures
+			err := json.NewEncoder(w).Encode(admin.Proposals())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			return
+		} else if r.Method == "POST" {
+			// co-sign a proposal
+			err := admin.CoSign(ctx, r.URL.Query().Get("id"), privKey)
+			if errors.Is(err, superadmin.ErrNoProposal) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			return
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	})
 	http.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
 		graphText := optimized.Info()
 		w.WriteHeader(http.StatusOK)
@@ -130,5 +195,29 @@ Route from %s to %s:
 		w.Write([]byte(body))
 		return
 	})
+	http.HandleFunc("/sessions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			// list active sessions
+			err := json.NewEncoder(w).Encode(sessions.List())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			return
+		} else if r.Method == "DELETE" {
+			// kick a session
+			err := sessions.Kick(r.URL.Query().Get("id"))
+			if errors.Is(err, session.ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("OK"))
+			return
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	})
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
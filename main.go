@@ -7,13 +7,19 @@ import (
 	"github.com/GlazeLab/PureGamer/src/modules/optimizer"
 	"github.com/GlazeLab/PureGamer/src/modules/pinging"
 	"github.com/GlazeLab/PureGamer/src/modules/relaying"
+	"github.com/GlazeLab/PureGamer/src/modules/session"
 	"github.com/GlazeLab/PureGamer/src/modules/superadmin"
 	"github.com/GlazeLab/PureGamer/src/node"
 	logging "github.com/ipfs/go-log/v2"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	ctx := context.TODO()
+	// stopping the node cancels ctx, for the modules to save their state
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 	n, err := node.Listen(ctx)
 	if err != nil {
 		panic(err)
@@ -45,9 +51,18 @@ func main() {
 	optimized.Handle(ctx)
 	go optimized.RunSpeedTest(ctx)
 
-	err = entry.Listen(n, exits, optimized)
+	sessions := session.NewRegistry()
+	err = entry.Listen(n, exits, optimized, sessions)
+	if err != nil {
+		panic(err)
+	}
+	<-ctx.Done()
+	err = optimized.Close()
+	if err != nil {
+		panic(err)
+	}
+	err = n.Store.Close()
 	if err != nil {
 		panic(err)
 	}
-	select {}
 }
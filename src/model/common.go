@@ -1,3 +1,56 @@
 package model
 
-type Latencies map[string]float64
+import (
+	"fmt"
+	"time"
+)
+
+// Latency summarizes the samples of one speed test of a link. Times are in
+// milliseconds with microsecond precision.
+type Latency struct {
+	Mean float64 `json:"mean" msgpack:"mean"`
+	Min  float64 `json:"min" msgpack:"min"`
+	// Jitter is the standard deviation of the samples.
+	Jitter float64 `json:"jitter" msgpack:"jitter"`
+	// Loss is the ratio of samples that got no answer, from 0 to 1.
+	Loss float64 `json:"loss" msgpack:"loss"`
+}
+
+type Latencies map[string]Latency
+
+// Report is what a node publishes after each speed test. Reports travel in
+// pubsub messages signed by their node.
+type Report struct {
+	// Seq grows with every report of the node, also across restarts.
+	Seq uint64 `json:"seq" msgpack:"seq"`
+	// Timestamp is when the report was made, in unix milliseconds.
+	Timestamp int64     `json:"timestamp" msgpack:"timestamp"`
+	Latencies Latencies `json:"latencies" msgpack:"latencies"`
+	// Reverse holds the delays from the peers to the node, when links carry
+	// one-way delays.
+	Reverse Latencies `json:"reverse,omitempty" msgpack:"reverse,omitempty"`
+	// Load is the number of streams the node relays or exits.
+	Load uint64 `json:"load" msgpack:"load"`
+}
+
+// Milliseconds converts d to milliseconds, keeping microseconds.
+func Milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// Duration returns the mean latency as a duration.
+func (l Latency) Duration() time.Duration {
+	return time.Duration(l.Mean * float64(time.Millisecond))
+}
+
+// Half is the one-way share of a round trip.
+func (l Latency) Half() Latency {
+	l.Mean /= 2
+	l.Min /= 2
+	l.Jitter /= 2
+	return l
+}
+
+func (l Latency) String() string {
+	return fmt.Sprintf("%.3fms (min %.3fms, jitter %.3fms, loss %.0f%%)", l.Mean, l.Min, l.Jitter, l.Loss*100)
+}
@@ -1,11 +1,29 @@
 package model
 
+import (
+	"github.com/vmihailenco/msgpack/v5"
+	"net"
+	"strconv"
+	"strings"
+)
+
 type WhiteOrBlackList struct {
 	Type      string   `json:"type" msgpack:"type"`
 	WhiteList []string `json:"white_list" msgpack:"white_list"`
 	BlackList []string `json:"black_list" msgpack:"black_list"`
 }
 
+// Backend is one of the servers a game is hosted on.
+type Backend struct {
+	Host   string `json:"host" msgpack:"host"`
+	Port   uint64 `json:"port" msgpack:"port"`
+	Weight uint64 `json:"weight" msgpack:"weight"`
+}
+
+func (b Backend) Address() string {
+	return net.JoinHostPort(b.Host, strconv.FormatUint(b.Port, 10))
+}
+
 type Game struct {
 	ID                string           `json:"id" msgpack:"id"`
 	Protocol          string           `json:"protocol" msgpack:"protocol"`
@@ -15,26 +33,155 @@ type Game struct {
 	ExitNode          WhiteOrBlackList `json:"exit_node" msgpack:"exit_node"`
 	EntryNode         WhiteOrBlackList `json:"entry_node" msgpack:"entry_node"`
 	SpeedTestProtocol string           `json:"speed_test_protocol" msgpack:"speed_test_protocol"`
+	MaxSessions       uint64           `json:"max_sessions" msgpack:"max_sessions"`
+	AcceptBacklog     uint64           `json:"accept_backlog" msgpack:"accept_backlog"`
+	Backends          []Backend        `json:"backends" msgpack:"backends"`
+	Balance           string           `json:"balance" msgpack:"balance"`
+	Redundancy        uint64           `json:"redundancy" msgpack:"redundancy"`
+	Cost              CostWeights      `json:"cost" msgpack:"cost"`
+	Strategy          string           `json:"strategy" msgpack:"strategy"`
+	PinnedRoutes      [][]string       `json:"pinned_routes" msgpack:"pinned_routes"`
+	AvoidNodes        []string         `json:"avoid_nodes" msgpack:"avoid_nodes"`
+	PreferExits       []string         `json:"prefer_exits" msgpack:"prefer_exits"`
+}
+
+// Servers returns the backends of the game, or its Host and Port when no
+// backends are configured.
+func (g Game) Servers() []Backend {
+	if len(g.Backends) > 0 {
+		return g.Backends
+	}
+	return []Backend{{Host: g.Host, Port: g.Port, Weight: 1}}
+}
+
+// BackendVertex names a backend of a game in the latency graph. Exit nodes
+// report their latency to each backend, and the backend leads to the game.
+func BackendVertex(gameId string, address string) string {
+	return gameId + "@" + address
+}
+
+// ParseBackendVertex splits a vertex made by BackendVertex.
+func ParseBackendVertex(vertex string) (string, string, bool) {
+	return strings.Cut(vertex, "@")
 }
 
 type System struct {
 	ListenHost string `json:"listen_host" msgpack:"listen_host"`
+	// EdgeExpiryRounds is how many speed test rounds a latency report is
+	// trusted for, 0 for the default.
+	EdgeExpiryRounds uint64 `json:"edge_expiry_rounds" msgpack:"edge_expiry_rounds"`
+	// A new route replaces the current one of a game only when it costs
+	// RouteSwitchMargin less, and RouteSwitchPercent percent less, for
+	// RouteSwitchHold seconds. Zero values select the defaults.
+	RouteSwitchMargin  float64 `json:"route_switch_margin" msgpack:"route_switch_margin"`
+	RouteSwitchPercent float64 `json:"route_switch_percent" msgpack:"route_switch_percent"`
+	RouteSwitchHold    uint64  `json:"route_switch_hold" msgpack:"route_switch_hold"`
+	// OneWayDelay makes links carry the delay of each way instead of round
+	// trips: "synced" trusts the clocks of the nodes, "estimated" estimates
+	// their offsets. Empty keeps round trips. Asymmetric links only show with
+	// "synced": like NTP, "estimated" takes the fastest probe to be as long
+	// each way, which splits the round trip in two halves. Only the way to the
+	// game is weighed, replies come back over the same hops.
+	OneWayDelay string `json:"one_way_delay" msgpack:"one_way_delay"`
 }
 
 type Config struct {
-	Games  []Game `json:"games" msgpack:"games"`
-	System System `json:"system" msgpack:"system"`
+	// Version grows with every config the super admin sends. Nodes only apply
+	// configs newer than the one they have.
+	Version uint64 `json:"version" msgpack:"version"`
+	// IssuedAt is when the config was sent, in Unix milliseconds.
+	IssuedAt int64  `json:"issued_at" msgpack:"issued_at"`
+	Games    []Game `json:"games" msgpack:"games"`
+	System   System `json:"system" msgpack:"system"`
+}
+
+// Signature is made by the admin key named KeyID, see utils.KeyID, with
+// Algorithm.
+type Signature struct {
+	KeyID     string `json:"key_id" msgpack:"key_id"`
+	Algorithm string `json:"algorithm" msgpack:"algorithm"`
+	Sign      string `json:"sign" msgpack:"sign"`
 }
 
 type SignedConfig struct {
-	Config Config `json:"config" msgpack:"config"`
-	Sign   string `json:"sign" msgpack:"sign"`
+	// Config is the encoded Config exactly as it was signed. It is decoded
+	// once the signatures are verified, and passed on as is, so that fields
+	// unknown to this version are kept.
+	Config msgpack.RawMessage `json:"config" msgpack:"config"`
+	// Sign is the single signature of configs sent by older versions, made
+	// with Algorithm, empty for the legacy ECDSA over MD5.
+	Sign      string `json:"sign" msgpack:"sign"`
+	Algorithm string `json:"algorithm" msgpack:"algorithm"`
+	// Signatures are made by the admins who approved the config.
+	Signatures []Signature `json:"signatures" msgpack:"signatures"`
+}
+
+// KeyRotation adds and revokes the admin keys trusted to sign configs. Seq
+// numbers the rotations, each one following the previous.
+type KeyRotation struct {
+	Seq      uint64   `json:"seq" msgpack:"seq"`
+	IssuedAt int64    `json:"issued_at" msgpack:"issued_at"`
+	Add      []string `json:"add" msgpack:"add"`
+	Revoke   []string `json:"revoke" msgpack:"revoke"`
+}
+
+// SignedKeyRotation is a KeyRotation signed by admin keys trusted before it.
+type SignedKeyRotation struct {
+	// Rotation is the encoded KeyRotation exactly as it was signed.
+	Rotation   msgpack.RawMessage `json:"rotation" msgpack:"rotation"`
+	Signatures []Signature        `json:"signatures" msgpack:"signatures"`
+}
+
+// Kinds of proposals.
+const (
+	ProposeConfig      = "config"
+	ProposeKeyRotation = "keys"
+)
+
+// Proposal is a Config or KeyRotation, encoded in Payload, waiting for
+// enough admins to sign it.
+type Proposal struct {
+	Kind       string      `json:"kind" msgpack:"kind"`
+	Payload    []byte      `json:"payload" msgpack:"payload"`
+	Signatures []Signature `json:"signatures" msgpack:"signatures"`
+}
+
+// ConfigDigest is announced by nodes to tell which config they applied.
+type ConfigDigest struct {
+	Version uint64 `json:"version" msgpack:"version"`
+	// Hash is the SHA-256 of the signed config payload.
+	Hash []byte `json:"hash" msgpack:"hash"`
+	// KeySeq is the Seq of the last key rotation applied.
+	KeySeq uint64 `json:"key_seq" msgpack:"key_seq"`
+}
+
+// ConfigSyncRequest asks a peer for its config when it is newer than Version,
+// and for its key rotations after KeySeq.
+type ConfigSyncRequest struct {
+	Version uint64 `json:"version" msgpack:"version"`
+	KeySeq  uint64 `json:"key_seq" msgpack:"key_seq"`
+}
+
+// ConfigSyncResponse holds the encoded SignedKeyRotation and SignedConfig
+// messages a peer asked for, Config being empty when it is not newer.
+type ConfigSyncResponse struct {
+	Rotations [][]byte `json:"rotations" msgpack:"rotations"`
+	Config    []byte   `json:"config" msgpack:"config"`
 }
 
 type FixedConfig struct {
-	SuperAdminPubKey string   `json:"super_admin_pub_key" msgpack:"super_admin_pub_key"`
-	ConfigPath       string   `json:"config_path" msgpack:"config_path"`
-	DataPath         string   `json:"data_path" msgpack:"data_path"`
-	BoostrapNodes    []string `json:"bootstrap_nodes" msgpack:"bootstrap_nodes"`
-	Port             uint     `json:"port" msgpack:"port"`
+	SuperAdminPubKey string `json:"super_admin_pub_key" msgpack:"super_admin_pub_key"`
+	// AdminPubKeys are trusted to sign configs along with SuperAdminPubKey.
+	AdminPubKeys []string `json:"admin_pub_keys" msgpack:"admin_pub_keys"`
+	// AdminThreshold is how many admin keys must sign a config or key
+	// rotation before it is applied, 0 for one.
+	AdminThreshold uint64 `json:"admin_threshold" msgpack:"admin_threshold"`
+	// LegacySignaturesUntil is the RFC 3339 time after which configs signed
+	// over MD5 are rejected. Empty accepts them until a config signed
+	// otherwise is applied.
+	LegacySignaturesUntil string   `json:"legacy_signatures_until" msgpack:"legacy_signatures_until"`
+	ConfigPath            string   `json:"config_path" msgpack:"config_path"`
+	DataPath              string   `json:"data_path" msgpack:"data_path"`
+	BoostrapNodes         []string `json:"bootstrap_nodes" msgpack:"bootstrap_nodes"`
+	Port                  uint     `json:"port" msgpack:"port"`
 }
@@ -0,0 +1,31 @@
+package model
+
+// CostWeights tells how much a game cares about each quality of a link. The
+// cost of an edge is the weighted sum of its mean latency and jitter in
+// milliseconds, its loss in percent, and the number of streams relayed by
+// the node it leads to.
+type CostWeights struct {
+	Latency float64 `json:"latency" msgpack:"latency"`
+	Jitter  float64 `json:"jitter" msgpack:"jitter"`
+	Loss    float64 `json:"loss" msgpack:"loss"`
+	Load    float64 `json:"load" msgpack:"load"`
+}
+
+// DefaultCostWeights is used by games that do not set their own.
+var DefaultCostWeights = CostWeights{Latency: 1, Jitter: 1, Loss: 10, Load: 0.1}
+
+// Cost gives the weight of the edge leaving from, knowing the load of the
+// node it leads to. An infinite weight leaves the edge out.
+type Cost func(from string, edge Edge, load float64) float64
+
+// Cost returns the cost function of the weights, or the one of
+// DefaultCostWeights when all weights are zero.
+func (w CostWeights) Cost() Cost {
+	if w == (CostWeights{}) {
+		w = DefaultCostWeights
+	}
+	return func(from string, edge Edge, load float64) float64 {
+		latency := edge.Latency
+		return w.Latency*latency.Mean + w.Jitter*latency.Jitter + w.Loss*latency.Loss*100 + w.Load*load
+	}
+}
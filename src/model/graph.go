@@ -1,34 +1,56 @@
 package model
 
 import (
-	"container/heap"
 	"fmt"
 	"math"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Edge represents an edge in the graph.
 type Edge struct {
 	To     string
 	Weight float64
+	// Latency holds the measured metrics of the link, if any.
+	Latency Latency
+	// Updated is when the edge was last added or updated.
+	Updated time.Time
 }
 
 // Graph represents a graph with an adjacency list.
 type Graph struct {
 	adjacencyList map[string][]Edge
-	lock          sync.RWMutex // 用于保证并发安全
+	// load is the load advertised by each node.
+	load map[string]float64
+	// loadDropped is the load of each node when the trees reaching it were
+	// last dropped for it.
+	loadDropped map[string]float64
+	// cache holds shortest-path trees. Readers holding the read lock share
+	// it under cacheLock, writers holding the lock own it.
+	cache     map[string]*pathTree
+	cacheLock sync.Mutex
+	lock      sync.RWMutex // 用于保证并发安全
 }
 
 // NewGraph creates a new graph.
 func NewGraph() *Graph {
-	return &Graph{adjacencyList: make(map[string][]Edge)}
+	return &Graph{
+		adjacencyList: make(map[string][]Edge),
+		load:          make(map[string]float64),
+		loadDropped:   make(map[string]float64),
+		cache:         make(map[string]*pathTree),
+	}
 }
 
 func (g *Graph) Flush() {
 	g.lock.Lock()
 	defer g.lock.Unlock()
 	g.adjacencyList = make(map[string][]Edge)
+	g.load = make(map[string]float64)
+	g.loadDropped = make(map[string]float64)
+	g.cache = make(map[string]*pathTree)
 }
 
 // AddEdge adds or updates an edge to the graph.
@@ -40,12 +62,46 @@ func (g *Graph) AddEdge(from, to string, weight float64) {
 	for i, edge := range g.adjacencyList[from] {
 		if edge.To == to {
 			g.adjacencyList[from][i].Weight = weight
+			g.adjacencyList[from][i].Updated = time.Now()
+			g.edgeChanged(from, &edge, &g.adjacencyList[from][i])
 			return
 		}
 	}
 
 	// If edge does not exist, add it
-	g.adjacencyList[from] = append(g.adjacencyList[from], Edge{To: to, Weight: weight})
+	added := Edge{To: to, Weight: weight, Updated: time.Now()}
+	g.adjacencyList[from] = append(g.adjacencyList[from], added)
+	g.edgeChanged(from, nil, &added)
+}
+
+// AddLink adds or updates a measured edge, weighted by its mean latency.
+func (g *Graph) AddLink(from, to string, latency Latency) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	for i, edge := range g.adjacencyList[from] {
+		if edge.To == to {
+			g.adjacencyList[from][i].Weight = latency.Mean
+			g.adjacencyList[from][i].Latency = latency
+			g.adjacencyList[from][i].Updated = time.Now()
+			g.edgeChanged(from, &edge, &g.adjacencyList[from][i])
+			return
+		}
+	}
+	added := Edge{To: to, Weight: latency.Mean, Latency: latency, Updated: time.Now()}
+	g.adjacencyList[from] = append(g.adjacencyList[from], added)
+	g.edgeChanged(from, nil, &added)
+}
+
+// SetLoad records the load advertised by node.
+func (g *Graph) SetLoad(node string, load float64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if old, ok := g.load[node]; ok && old == load {
+		return
+	}
+	g.load[node] = load
+	g.loadChanged(node, load)
 }
 
 func (g *Graph) AddBidirectionalEdge(from, to string, weight float64) {
@@ -62,6 +118,7 @@ func (g *Graph) RemoveEdge(from, to string) {
 	for i, edge := range edges {
 		if edge.To == to {
 			g.adjacencyList[from] = append(edges[:i], edges[i+1:]...)
+			g.edgeChanged(from, &edge, nil)
 			return
 		}
 	}
@@ -77,8 +134,12 @@ func (g *Graph) RemoveNode(node string) {
 	g.lock.Lock()
 	defer g.lock.Unlock()
 
+	g.nodeChanged(node)
+
 	// Remove all edges from this node
 	delete(g.adjacencyList, node)
+	delete(g.load, node)
+	delete(g.loadDropped, node)
 
 	// Remove all edges to this node
 	for from, edges := range g.adjacencyList {
@@ -93,6 +154,108 @@ func (g *Graph) RemoveNode(node string) {
 	}
 }
 
+// Link is an edge together with the node it leaves, as kept in snapshots.
+type Link struct {
+	From    string    `json:"from" msgpack:"from"`
+	To      string    `json:"to" msgpack:"to"`
+	Weight  float64   `json:"weight" msgpack:"weight"`
+	Latency Latency   `json:"latency" msgpack:"latency"`
+	Updated time.Time `json:"updated" msgpack:"updated"`
+}
+
+// GraphSnapshot is a copy of the edges and loads of a graph.
+type GraphSnapshot struct {
+	Links []Link             `json:"links" msgpack:"links"`
+	Load  map[string]float64 `json:"load" msgpack:"load"`
+	Taken time.Time          `json:"taken" msgpack:"taken"`
+}
+
+// Snapshot copies the edges and loads of the graph.
+func (g *Graph) Snapshot() GraphSnapshot {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	snapshot := GraphSnapshot{Load: make(map[string]float64, len(g.load)), Taken: time.Now()}
+	for from, edges := range g.adjacencyList {
+		for _, edge := range edges {
+			snapshot.Links = append(snapshot.Links, Link{
+				From:    from,
+				To:      edge.To,
+				Weight:  edge.Weight,
+				Latency: edge.Latency,
+				Updated: edge.Updated,
+			})
+		}
+	}
+	for node, load := range g.load {
+		snapshot.Load[node] = load
+	}
+	return snapshot
+}
+
+// Restore adds the links of a snapshot that the graph does not have yet,
+// keeping their update times. Edges the graph already has are newer.
+func (g *Graph) Restore(links []Link, load map[string]float64) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for _, link := range links {
+		if slices.ContainsFunc(g.adjacencyList[link.From], func(edge Edge) bool { return edge.To == link.To }) {
+			continue
+		}
+		added := Edge{
+			To:      link.To,
+			Weight:  link.Weight,
+			Latency: link.Latency,
+			Updated: link.Updated,
+		}
+		g.adjacencyList[link.From] = append(g.adjacencyList[link.From], added)
+		g.edgeChanged(link.From, nil, &added)
+	}
+	for node, l := range load {
+		if _, ok := g.load[node]; !ok {
+			g.load[node] = l
+			g.loadChanged(node, l)
+		}
+	}
+}
+
+// ExpireEdges removes the edges last updated before the given time, and
+// returns how many were removed.
+func (g *Graph) ExpireEdges(before time.Time) int {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	removed := 0
+	for from, edges := range g.adjacencyList {
+		kept := edges[:0]
+		for _, edge := range edges {
+			if edge.Updated.Before(before) {
+				removed++
+				g.edgeChanged(from, &edge, nil)
+				continue
+			}
+			kept = append(kept, edge)
+		}
+		if len(kept) == 0 {
+			delete(g.adjacencyList, from)
+			continue
+		}
+		g.adjacencyList[from] = kept
+	}
+	return removed
+}
+
+// FindEdge returns the edge from one node to another, if there is one.
+func (g *Graph) FindEdge(from, to string) (Edge, bool) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	for _, edge := range g.adjacencyList[from] {
+		if edge.To == to {
+			return edge, true
+		}
+	}
+	return Edge{}, false
+}
+
 func (g *Graph) IterateEdges(from string) []string {
 	g.lock.RLock()
 	defer g.lock.RUnlock()
@@ -123,7 +286,7 @@ func (g *Graph) PrintRoutes(start string, end string) string {
 	g.lock.RLock()
 	defer g.lock.RUnlock()
 	strList := make([]string, 0, len(g.adjacencyList)*2)
-	path, latency := g.ShortestPath(start, end)
+	path, latency := g.shortestPath(start, end, nil, nil)
 	path = append(path, end)
 	path = append([]string{start}, path...)
 	isInPath := make(map[string]map[string]struct{})
@@ -189,48 +352,171 @@ func (pq *PriorityQueue) Pop() interface{} {
 func (g *Graph) ShortestPath(start, target string) ([]string, float64) {
 	g.lock.RLock()
 	defer g.lock.RUnlock()
+	return g.shortestPath(start, target, nil, nil)
+}
 
-	dist := make(map[string]float64)
-	prev := make(map[string]string)
+// ShortestPathBy is ShortestPath with the edges weighted by cost.
+func (g *Graph) ShortestPathBy(start, target string, cost Cost) ([]string, float64) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.shortestPath(start, target, cost, nil)
+}
 
-	for node, edges := range g.adjacencyList {
-		dist[node] = math.Inf(1)
-		for _, edge := range edges {
-			dist[edge.To] = math.Inf(1)
+// weight returns the weight of edge under cost, or its own weight when cost
+// is nil. The caller must hold the lock.
+func (g *Graph) weight(from string, edge Edge, cost Cost) float64 {
+	if cost == nil {
+		return edge.Weight
+	}
+	return cost(from, edge, g.load[edge.To])
+}
+
+// PathCost returns the total weight under cost along the nodes of path, or
+// +Inf when one of its edges is missing.
+func (g *Graph) PathCost(path []string, cost Cost) float64 {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.pathCost(path, cost)
+}
+
+// pathCost is PathCost for callers holding the lock.
+func (g *Graph) pathCost(path []string, cost Cost) float64 {
+	var total float64
+	for i := 0; i+1 < len(path); i++ {
+		found := false
+		for _, edge := range g.adjacencyList[path[i]] {
+			if edge.To == path[i+1] {
+				total += g.weight(path[i], edge, cost)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return math.Inf(1)
 		}
 	}
-	dist[start] = 0
+	return total
+}
 
-	pq := make(PriorityQueue, 0)
-	heap.Push(&pq, &Item{node: start, distance: 0})
+// DisjointPaths returns up to n paths from start to target that share no
+// intermediate node, best first. Every path is the shortest one left after
+// the nodes of the previous ones are taken out.
+func (g *Graph) DisjointPaths(start, target string, n int, cost Cost) [][]string {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
 
-	for pq.Len() > 0 {
-		item := heap.Pop(&pq).(*Item)
-		currentNode := item.node
+	used := make(map[string]struct{})
+	direct := false
+	skip := func(from, to string) bool {
+		if _, ok := used[to]; ok {
+			return true
+		}
+		return direct && from == start && to == target
+	}
 
-		if currentNode == target {
+	paths := make([][]string, 0, n)
+	for len(paths) < n {
+		path, _ := g.shortestPath(start, target, cost, skip)
+		if path == nil {
 			break
 		}
+		paths = append(paths, path)
+		if len(path) == 0 {
+			direct = true
+		}
+		for _, node := range path {
+			used[node] = struct{}{}
+		}
+	}
+	return paths
+}
 
-		for _, edge := range g.adjacencyList[currentNode] {
-			alt := dist[currentNode] + edge.Weight
-			if alt < dist[edge.To] {
-				dist[edge.To] = alt
-				prev[edge.To] = currentNode
-				heap.Push(&pq, &Item{node: edge.To, distance: alt})
+// KShortestPaths returns up to k loop-free paths from start to target with
+// their costs, cheapest first, using Yen's algorithm. Like ShortestPath, the
+// paths leave out start and target.
+func (g *Graph) KShortestPaths(start, target string, k int, cost Cost) ([][]string, []float64) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	first, dist := g.shortestPath(start, target, cost, nil)
+	if first == nil || k <= 0 {
+		return nil, nil
+	}
+	full := func(path []string) []string {
+		return append(append([]string{start}, path...), target)
+	}
+	accepted := [][]string{full(first)}
+	costs := []float64{dist}
+
+	type candidate struct {
+		path []string
+		cost float64
+	}
+	var candidates []candidate
+	known := map[string]struct{}{strings.Join(accepted[0], "\x00"): {}}
+
+	for len(accepted) < k {
+		last := accepted[len(accepted)-1]
+		for i := 0; i < len(last)-1; i++ {
+			spur := last[i]
+			root := last[:i+1]
+
+			// leave out the next edge of every accepted path sharing the
+			// root, and the root itself, so the spur path is new and loop-free
+			removedEdges := make(map[[2]string]struct{})
+			for _, path := range accepted {
+				if len(path) > i+1 && slices.Equal(path[:i+1], root) {
+					removedEdges[[2]string{path[i], path[i+1]}] = struct{}{}
+				}
+			}
+			removedNodes := make(map[string]struct{}, i)
+			for _, node := range root[:i] {
+				removedNodes[node] = struct{}{}
 			}
+			skip := func(from, to string) bool {
+				if _, ok := removedNodes[to]; ok {
+					return true
+				}
+				_, ok := removedEdges[[2]string{from, to}]
+				return ok
+			}
+
+			spurPath, _ := g.shortestPath(spur, target, cost, skip)
+			if spurPath == nil {
+				continue
+			}
+			path := append(append(slices.Clone(root), spurPath...), target)
+			key := strings.Join(path, "\x00")
+			if _, ok := known[key]; ok {
+				continue
+			}
+			known[key] = struct{}{}
+			candidates = append(candidates, candidate{path: path, cost: g.pathCost(path, cost)})
 		}
+		if len(candidates) == 0 {
+			break
+		}
+		best := 0
+		for i, c := range candidates {
+			if c.cost < candidates[best].cost {
+				best = i
+			}
+		}
+		accepted = append(accepted, candidates[best].path)
+		costs = append(costs, candidates[best].cost)
+		candidates = append(candidates[:best], candidates[best+1:]...)
 	}
 
-	path := make([]string, 0)
-	u, ok := prev[target]
-	if !ok {
-		return nil, math.Inf(1) // Target node is not reachable from start
-	}
-	for u != start {
-		path = append([]string{u}, path...)
-		u = prev[u]
+	paths := make([][]string, len(accepted))
+	for i, path := range accepted {
+		paths[i] = path[1 : len(path)-1]
 	}
+	return paths, costs
+}
 
-	return path, dist[target]
+// shortestPath runs Dijkstra from start with the edges weighted by cost,
+// leaving out the edges skip returns true for. The caller must hold the lock.
+func (g *Graph) shortestPath(start, target string, cost Cost, skip func(from, to string) bool) ([]string, float64) {
+	dist, prev := g.dijkstra(start, target, cost, skip)
+	return walk(prev, dist, start, target)
 }
@@ -0,0 +1,175 @@
+package model
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testEdge is a weighted edge of a fixed test graph.
+type testEdge struct {
+	from, to string
+	weight   float64
+}
+
+func testGraph(edges []testEdge) *Graph {
+	g := NewGraph()
+	for _, edge := range edges {
+		g.AddEdge(edge.from, edge.to, edge.weight)
+	}
+	return g
+}
+
+// yenEdges is the graph of the example of Yen's algorithm, with seven
+// loop-free paths from C to H.
+var yenEdges = []testEdge{
+	{"C", "D", 3}, {"C", "E", 2},
+	{"D", "F", 4},
+	{"E", "D", 1}, {"E", "F", 2}, {"E", "G", 3},
+	{"F", "G", 2}, {"F", "H", 1},
+	{"G", "H", 2},
+}
+
+// checkLoopFree fails when a node shows up twice on the path from start to
+// target through path.
+func checkLoopFree(t *testing.T, start, target string, path []string) {
+	t.Helper()
+	seen := map[string]struct{}{start: {}, target: {}}
+	for _, node := range path {
+		if _, ok := seen[node]; ok {
+			t.Errorf("path %v from %s to %s loops through %s", path, start, target, node)
+		}
+		seen[node] = struct{}{}
+	}
+}
+
+func TestKShortestPaths(t *testing.T) {
+	tests := []struct {
+		name          string
+		edges         []testEdge
+		start, target string
+		k             int
+		want          [][]string
+		wantCosts     []float64
+	}{
+		{
+			name: "yen", edges: yenEdges, start: "C", target: "H", k: 3,
+			want:      [][]string{{"E", "F"}, {"E", "G"}},
+			wantCosts: []float64{5, 7, 8},
+		},
+		{
+			name: "fewer than k", edges: yenEdges, start: "C", target: "H", k: 10,
+			want:      [][]string{{"E", "F"}, {"E", "G"}},
+			wantCosts: []float64{5, 7, 8, 8, 8, 11, 11},
+		},
+		{
+			name: "single", edges: yenEdges, start: "C", target: "H", k: 1,
+			want:      [][]string{{"E", "F"}},
+			wantCosts: []float64{5},
+		},
+		{
+			name: "unreachable", edges: yenEdges, start: "H", target: "C", k: 3,
+		},
+		{
+			name: "direct", edges: []testEdge{{"A", "B", 5}, {"A", "C", 1}, {"C", "B", 1}}, start: "A", target: "B", k: 3,
+			want:      [][]string{{"C"}, {}},
+			wantCosts: []float64{2, 5},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := testGraph(test.edges)
+			paths, costs := g.KShortestPaths(test.start, test.target, test.k, nil)
+			if len(paths) != len(test.wantCosts) || !slices.Equal(costs, test.wantCosts) {
+				t.Fatalf("paths %v with costs %v, want costs %v", paths, costs, test.wantCosts)
+			}
+			for i, want := range test.want {
+				if !slices.Equal(paths[i], want) {
+					t.Errorf("path %d is %v, want %v", i, paths[i], want)
+				}
+			}
+			known := make(map[string]struct{})
+			for i, path := range paths {
+				checkLoopFree(t, test.start, test.target, path)
+				full := append(append([]string{test.start}, path...), test.target)
+				if cost := g.PathCost(full, nil); cost != costs[i] {
+					t.Errorf("path %v costs %v, reported %v", path, cost, costs[i])
+				}
+				if i > 0 && costs[i] < costs[i-1] {
+					t.Errorf("path %v costs less than the one before it", path)
+				}
+				key := strings.Join(full, "\x00")
+				if _, ok := known[key]; ok {
+					t.Errorf("path %v returned twice", path)
+				}
+				known[key] = struct{}{}
+			}
+		})
+	}
+}
+
+// disjointEdges leads from S to T through A, through B and directly. C only
+// reaches T through A.
+var disjointEdges = []testEdge{
+	{"S", "A", 1}, {"A", "T", 1},
+	{"S", "B", 2}, {"B", "T", 2},
+	{"S", "C", 1}, {"C", "A", 1},
+	{"S", "T", 10},
+}
+
+func TestDisjointPaths(t *testing.T) {
+	tests := []struct {
+		name          string
+		edges         []testEdge
+		start, target string
+		n             int
+		want          [][]string
+	}{
+		{
+			name: "best first", edges: disjointEdges, start: "S", target: "T", n: 2,
+			want: [][]string{{"A"}, {"B"}},
+		},
+		{
+			name: "fewer than n", edges: disjointEdges, start: "S", target: "T", n: 5,
+			want: [][]string{{"A"}, {"B"}, {}},
+		},
+		{
+			name: "shared relay", edges: []testEdge{
+				{"S", "X", 1}, {"X", "Y", 1}, {"Y", "T", 1},
+				{"S", "Z", 2}, {"Z", "Y", 1},
+			}, start: "S", target: "T", n: 3,
+			want: [][]string{{"X", "Y"}},
+		},
+		{
+			name: "unreachable", edges: disjointEdges, start: "T", target: "S", n: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := testGraph(test.edges)
+			paths := g.DisjointPaths(test.start, test.target, test.n, nil)
+			if len(paths) != len(test.want) {
+				t.Fatalf("paths %v, want %v", paths, test.want)
+			}
+			used := make(map[string]int)
+			last := 0.0
+			for i, path := range paths {
+				if !slices.Equal(path, test.want[i]) {
+					t.Errorf("path %d is %v, want %v", i, path, test.want[i])
+				}
+				checkLoopFree(t, test.start, test.target, path)
+				for _, node := range path {
+					if j, ok := used[node]; ok {
+						t.Errorf("paths %d and %d share %s", j, i, node)
+					}
+					used[node] = i
+				}
+				cost := g.PathCost(append(append([]string{test.start}, path...), test.target), nil)
+				if cost < last {
+					t.Errorf("path %v costs less than the one before it", path)
+				}
+				last = cost
+			}
+		})
+	}
+}
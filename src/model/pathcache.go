@@ -0,0 +1,166 @@
+package model
+
+import (
+	"container/heap"
+	"math"
+)
+
+const (
+	// loadTolerance is how far, relative to the load the trees reaching a
+	// node were last dropped for, its load moves before they are dropped
+	// again. Loads change with every stream, and weigh little on routes.
+	loadTolerance = 0.1
+	// minLoadChange is the smallest move of a load that drops trees.
+	minLoadChange = 2
+)
+
+// pathTree is the tree of shortest paths from one node under one cost.
+type pathTree struct {
+	cost Cost
+	dist map[string]float64
+	prev map[string]string
+}
+
+// ShortestPathCached is ShortestPathBy backed by a cache of shortest-path
+// trees, one per start node and key. Callers give the same key only for the
+// same cost function, and call FlushCache when the meaning of a key changes.
+// Changes to the graph drop only the trees they may affect.
+func (g *Graph) ShortestPathCached(start, target string, key string, cost Cost) ([]string, float64) {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	cacheKey := key + "\x00" + start
+	g.cacheLock.Lock()
+	tree, ok := g.cache[cacheKey]
+	g.cacheLock.Unlock()
+	if !ok {
+		dist, prev := g.dijkstra(start, "", cost, nil)
+		tree = &pathTree{cost: cost, dist: dist, prev: prev}
+		g.cacheLock.Lock()
+		g.cache[cacheKey] = tree
+		g.cacheLock.Unlock()
+	}
+	return walk(tree.prev, tree.dist, start, target)
+}
+
+// FlushCache drops all cached shortest-path trees.
+func (g *Graph) FlushCache() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.cache = make(map[string]*pathTree)
+}
+
+// edgeChanged drops the trees a change of the edge leaving from may affect:
+// those it now gives a shorter way to its end, and those it was a costlier or
+// removed part of. A nil edge stands for no edge. The caller must hold the
+// write lock.
+func (g *Graph) edgeChanged(from string, old *Edge, updated *Edge) {
+	for key, tree := range g.cache {
+		reach, ok := tree.dist[from]
+		if !ok || math.IsInf(reach, 1) {
+			continue
+		}
+		oldWeight, newWeight := math.Inf(1), math.Inf(1)
+		to := ""
+		if old != nil {
+			oldWeight = g.weight(from, *old, tree.cost)
+			to = old.To
+		}
+		if updated != nil {
+			newWeight = g.weight(from, *updated, tree.cost)
+			to = updated.To
+		}
+		dist, ok := tree.dist[to]
+		if !ok {
+			dist = math.Inf(1)
+		}
+		switch {
+		case newWeight < oldWeight && reach+newWeight < dist:
+			delete(g.cache, key)
+		case newWeight > oldWeight && tree.prev[to] == from:
+			delete(g.cache, key)
+		}
+	}
+}
+
+// nodeChanged drops the trees that reach node, whose load or edges into it
+// changed. The caller must hold the write lock.
+func (g *Graph) nodeChanged(node string) {
+	for key, tree := range g.cache {
+		if dist, ok := tree.dist[node]; ok && !math.IsInf(dist, 1) {
+			delete(g.cache, key)
+		}
+	}
+}
+
+// loadChanged drops the trees reaching node when its load moved far enough
+// from the one they were last dropped for. Until then, the trees weigh its
+// edges with an older load. The caller must hold the write lock.
+func (g *Graph) loadChanged(node string, load float64) {
+	if dropped, ok := g.loadDropped[node]; ok && math.Abs(load-dropped) < max(dropped*loadTolerance, minLoadChange) {
+		return
+	}
+	g.loadDropped[node] = load
+	g.nodeChanged(node)
+}
+
+// dijkstra computes the distances from start and the node before each on its
+// shortest path, stopping once target is reached, or covering the graph when
+// target is empty. The caller must hold the lock.
+func (g *Graph) dijkstra(start, target string, cost Cost, skip func(from, to string) bool) (map[string]float64, map[string]string) {
+	dist := make(map[string]float64)
+	prev := make(map[string]string)
+
+	for node, edges := range g.adjacencyList {
+		dist[node] = math.Inf(1)
+		for _, edge := range edges {
+			dist[edge.To] = math.Inf(1)
+		}
+	}
+	dist[start] = 0
+
+	pq := make(PriorityQueue, 0)
+	heap.Push(&pq, &Item{node: start, distance: 0})
+
+	for pq.Len() > 0 {
+		item := heap.Pop(&pq).(*Item)
+		currentNode := item.node
+
+		if currentNode == target {
+			break
+		}
+		if item.distance > dist[currentNode] {
+			// a shorter way to the node was found after this one was queued
+			continue
+		}
+
+		for _, edge := range g.adjacencyList[currentNode] {
+			if skip != nil && skip(currentNode, edge.To) {
+				continue
+			}
+			alt := dist[currentNode] + g.weight(currentNode, edge, cost)
+			if alt < dist[edge.To] {
+				dist[edge.To] = alt
+				prev[edge.To] = currentNode
+				heap.Push(&pq, &Item{node: edge.To, distance: alt})
+			}
+		}
+	}
+	return dist, prev
+}
+
+// walk returns the nodes between start and target on the tree prev, and the
+// distance of target, or nil when target is not reachable.
+func walk(prev map[string]string, dist map[string]float64, start, target string) ([]string, float64) {
+	path := make([]string, 0)
+	u, ok := prev[target]
+	if !ok {
+		return nil, math.Inf(1) // Target node is not reachable from start
+	}
+	for u != start {
+		path = append([]string{u}, path...)
+		u = prev[u]
+	}
+
+	return path, dist[target]
+}
@@ -0,0 +1,118 @@
+package model
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	benchNodes  = 300
+	benchDegree = 8
+)
+
+// benchGraph builds a graph of benchNodes nodes, each linked to benchDegree
+// random others, like the latency reports of a mesh of relays.
+func benchGraph(r *rand.Rand) *Graph {
+	g := NewGraph()
+	for i := 0; i < benchNodes; i++ {
+		for j := 0; j < benchDegree; j++ {
+			to := r.Intn(benchNodes)
+			if to == i {
+				continue
+			}
+			g.AddLink(benchNode(i), benchNode(to), benchLatency(r))
+		}
+		g.SetLoad(benchNode(i), float64(r.Intn(100)))
+	}
+	return g
+}
+
+func benchNode(i int) string {
+	return fmt.Sprintf("node-%d", i)
+}
+
+func benchLatency(r *rand.Rand) Latency {
+	mean := 5 + r.Float64()*150
+	return Latency{Mean: mean, Min: mean * 0.9, Jitter: r.Float64() * 10, Loss: r.Float64() * 0.02}
+}
+
+// benchUpdates makes one change to the graph, as a report of a node would.
+type benchUpdates func(g *Graph, r *rand.Rand)
+
+var benchCases = []struct {
+	name    string
+	updates benchUpdates
+}{
+	{"static", nil},
+	{"links", func(g *Graph, r *rand.Rand) {
+		g.AddLink(benchNode(r.Intn(benchNodes)), benchNode(r.Intn(benchNodes)), benchLatency(r))
+	}},
+	{"load", func(g *Graph, r *rand.Rand) {
+		// a stream more or less, as relays open and close them
+		node := benchNode(r.Intn(benchNodes))
+		g.SetLoad(node, float64(50+r.Intn(3)))
+	}},
+}
+
+// benchLookups runs parallel lookups of random routes with lookup while the
+// graph is updated every 100µs.
+func benchLookups(b *testing.B, lookup func(g *Graph, start, target string) ([]string, float64)) {
+	for _, c := range benchCases {
+		b.Run(c.name, func(b *testing.B) {
+			g := benchGraph(rand.New(rand.NewSource(1)))
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			if c.updates != nil {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					r := rand.New(rand.NewSource(2))
+					ticker := time.NewTicker(100 * time.Microsecond)
+					defer ticker.Stop()
+					for {
+						select {
+						case <-stop:
+							return
+						case <-ticker.C:
+							c.updates(g, r)
+						}
+					}
+				}()
+			}
+
+			var seed sync.Mutex
+			next := int64(3)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				seed.Lock()
+				r := rand.New(rand.NewSource(next))
+				next++
+				seed.Unlock()
+				// entry nodes are few, games are many
+				for pb.Next() {
+					lookup(g, benchNode(r.Intn(8)), benchNode(r.Intn(benchNodes)))
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func BenchmarkShortestPathBy(b *testing.B) {
+	cost := DefaultCostWeights.Cost()
+	benchLookups(b, func(g *Graph, start, target string) ([]string, float64) {
+		return g.ShortestPathBy(start, target, cost)
+	})
+}
+
+func BenchmarkShortestPathCached(b *testing.B) {
+	cost := DefaultCostWeights.Cost()
+	benchLookups(b, func(g *Graph, start, target string) ([]string, float64) {
+		return g.ShortestPathCached(start, target, "bench", cost)
+	})
+}
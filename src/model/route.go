@@ -0,0 +1,47 @@
+package model
+
+// RouteTicket allows one hop of a relay route to forward a stream. The entry
+// node signs one ticket per hop, so a hop only learns its neighbours and the
+// hops after it.
+type RouteTicket struct {
+	GameID string `msgpack:"game_id"`
+	Entry  string `msgpack:"entry"`
+	Prev   string `msgpack:"prev"`
+	Hop    string `msgpack:"hop"`
+	// Next is empty when Hop is the exit node.
+	Next string `msgpack:"next"`
+	// TTL is the number of hops left after this one.
+	TTL    uint8 `msgpack:"ttl"`
+	Expire int64 `msgpack:"expire"`
+	// Client and Backend are only told to the exit node, to pick a backend.
+	Client  string `msgpack:"client"`
+	Backend string `msgpack:"backend"`
+	// Session is only told to the exit node, to group redundant paths.
+	Session string `msgpack:"session"`
+}
+
+type SignedTicket struct {
+	Ticket []byte `msgpack:"ticket"`
+	Sign   []byte `msgpack:"sign"`
+}
+
+// RouteHeader is the first frame of a relay stream. Its first ticket is for
+// the hop receiving it.
+type RouteHeader struct {
+	Tickets []SignedTicket `msgpack:"tickets"`
+}
+
+const (
+	RouteAccepted uint8 = iota
+	RouteInvalid
+	RouteUnauthorized
+	RouteUnreachable
+)
+
+// RouteStatus is the first frame sent back on a relay stream. RouteAccepted
+// means the exit node accepted the stream, any other code comes with the
+// reason the route was rejected.
+type RouteStatus struct {
+	Code  uint8  `msgpack:"code"`
+	Error string `msgpack:"error"`
+}
@@ -1,227 +1,323 @@
 package entry
 
 import (
+	"errors"
 	"fmt"
 	"github.com/GlazeLab/PureGamer/src/model"
 	"github.com/GlazeLab/PureGamer/src/modules/exit"
 	"github.com/GlazeLab/PureGamer/src/modules/optimizer"
 	"github.com/GlazeLab/PureGamer/src/modules/relaying"
+	"github.com/GlazeLab/PureGamer/src/modules/session"
+	"github.com/GlazeLab/PureGamer/src/modules/tunnel"
 	"github.com/GlazeLab/PureGamer/src/utils"
 	logging "github.com/ipfs/go-log/v2"
 	"github.com/pires/go-proxyproto"
 	"io"
 	"net"
+	"slices"
+	"sync"
 )
 
 var log = logging.Logger("entry")
 
-func Listen(n *model.Node, exits *exit.Exit, optimize *optimizer.Optimizer) error {
-	gameMap := make(map[string]model.Game)
-	listening := make(map[string]interface{})
+// failoverRoutes is how many routes are tried before a connection is given up.
+const failoverRoutes = 3
+
+type gateway struct {
+	n        *model.Node
+	exits    *exit.Exit
+	optimize *optimizer.Optimizer
+	sessions *session.Registry
+	nodeId   string
+
+	lock      sync.RWMutex
+	gameMap   map[string]model.Game
+	listening map[string]*listener
+}
+
+func Listen(n *model.Node, exits *exit.Exit, optimize *optimizer.Optimizer, sessions *session.Registry) error {
+	g := &gateway{
+		n:         n,
+		exits:     exits,
+		optimize:  optimize,
+		sessions:  sessions,
+		nodeId:    n.Host.ID().String(),
+		gameMap:   make(map[string]model.Game),
+		listening: make(map[string]*listener),
+	}
+
+	n.FlushConfigCallbacks = append(n.FlushConfigCallbacks, g.reconcile)
+
+	return g.reconcile(*n.Config)
+}
+
+func (g *gateway) game(gameId string) model.Game {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return g.gameMap[gameId]
+}
 
-	for _, game := range n.Config.Games {
+// reconcile brings the listeners in line with c. Listeners of games whose
+// address did not change are kept, so their players stay connected.
+func (g *gateway) reconcile(c model.Config) error {
+	gameMap := make(map[string]model.Game)
+	for _, game := range c.Games {
 		gameMap[game.ID] = game
 	}
-	nodeId := n.Host.ID().String()
 
-	listen := func(c model.Config) error {
-		for _, game := range c.Games {
-			if utils.IsNotAllowed(nodeId, game.EntryNode) {
-				continue
-			}
-			switch game.Protocol {
-			case "TCP", "HAProxy":
-				listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.System.ListenHost, game.ListenPort))
-				log.Info(fmt.Sprintf("Listening on %s:%d", c.System.ListenHost, game.ListenPort))
-				if err != nil {
-					return err
-				}
-				listening[game.ID] = listener
-				break
-			case "UDP":
-				listener, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", c.System.ListenHost, game.ListenPort))
-				log.Info(fmt.Sprintf("Listening on %s:%d", c.System.ListenHost, game.ListenPort))
-				if err != nil {
-					return err
-				}
-				listening[game.ID] = listener
-				break
-			}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.gameMap = gameMap
+
+	// stop everything that changed first, so that a port moving from one
+	// game to another is free by the time it is bound again
+	for gameId, l := range g.listening {
+		game, ok := gameMap[gameId]
+		if ok && !utils.IsNotAllowed(g.nodeId, game.EntryNode) && l.matches(game, c.System.ListenHost) {
+			continue
 		}
-		for gameId, listener := range listening {
-			listener := listener
-			gameId := gameId
-			switch gameMap[gameId].Protocol {
-			case "TCP":
-				go func() {
-					for {
-						income, err := listener.(net.Listener).Accept()
-						if err != nil {
-							log.Error(err)
-							return
-						}
-						func() {
-							defer income.Close()
-							relayNodes := optimize.OptimizedRoutes(nodeId, gameId)
-							log.Infof("Relays: %v", relayNodes)
-
-							if len(relayNodes) == 0 || relayNodes[len(relayNodes)-1] == nodeId {
-								if utils.IsNotAllowed(nodeId, gameMap[gameId].ExitNode) {
-									log.Warnf("This is not allowed to relay to %s", gameId)
-									return
-								}
-								err := exits.Handle(income, gameId, nil)
-								if err != nil {
-									log.Error(err)
-									return
-								}
-							} else {
-								relay, err := relaying.OpenRelay(n.CTX, n, gameId, relayNodes)
-								if err != nil {
-									log.Error(err)
-									return
-								}
-								defer relay.Close()
-
-								done := make(chan struct{})
-
-								go func() {
-									_, err = io.Copy(income, relay)
-									if err != nil {
-										log.Warn(err)
-									}
-									done <- struct{}{}
-								}()
-
-								go func() {
-									_, err = io.Copy(relay, income)
-									if err != nil {
-										log.Warn(err)
-									}
-									done <- struct{}{}
-								}()
-								<-done
-							}
-						}()
+		log.Infof("Stop listening on %s for %s", l.address, gameId)
+		err := l.socket.Close()
+		if err != nil {
+			log.Warn(err)
+		}
+		delete(g.listening, gameId)
+	}
+
+	var errs []error
+	for _, game := range c.Games {
+		if utils.IsNotAllowed(g.nodeId, game.EntryNode) || networkOf(game.Protocol) == "" {
+			continue
+		}
+		if l, ok := g.listening[game.ID]; ok {
+			l.setLimits(game.MaxSessions, game.AcceptBacklog)
+			continue
+		}
+		l, err := newListener(game, c.System.ListenHost)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Infof("Listening on %s for %s", l.address, game.ID)
+		g.listening[game.ID] = l
+		g.serve(game.ID, l)
+	}
+	return errors.Join(errs...)
+}
+
+func (g *gateway) serve(gameId string, l *listener) {
+	switch socket := l.socket.(type) {
+	case net.Listener:
+		go func() {
+			for {
+				income, err := socket.Accept()
+				if err != nil {
+					if !errors.Is(err, net.ErrClosed) {
+						log.Error(err)
 					}
-				}()
-				break
-			case "HAProxy":
+					return
+				}
 				go func() {
-					for {
-						income, err := listener.(net.Listener).Accept()
-
-						if err != nil {
-							log.Error(err)
-							return
-						}
-						func() {
-							defer income.Close()
-							log.Info(income.RemoteAddr().(*net.TCPAddr).IP)
-							relayNodes := optimize.OptimizedRoutes(nodeId, gameId)
-							proxyHeader := proxyproto.HeaderProxyFromAddrs(2, income.RemoteAddr(), income.LocalAddr())
-							log.Infof("Relays: %v", relayNodes)
-
-							if len(relayNodes) == 0 || relayNodes[len(relayNodes)-1] == nodeId {
-								if utils.IsNotAllowed(nodeId, gameMap[gameId].ExitNode) {
-									log.Warnf("This is not allowed to relay to %s", gameId)
-									return
-								}
-								err = exits.Handle(income, gameId, func(conn net.Conn) error {
-									_, err := proxyHeader.WriteTo(conn)
-									return err
-								})
-								if err != nil {
-									log.Error(err)
-									return
-								}
-							} else {
-								relay, err := relaying.OpenRelay(n.CTX, n, gameId, relayNodes)
-								if err != nil {
-									log.Error(err)
-									return
-								}
-								defer relay.Close()
-
-								_, err = proxyHeader.WriteTo(relay)
-								if err != nil {
-									log.Error(err)
-									return
-								}
-
-								done := make(chan struct{})
-
-								go func() {
-									_, err = io.Copy(income, relay)
-									if err != nil {
-										log.Warn(err)
-									}
-									done <- struct{}{}
-								}()
-
-								go func() {
-									_, err = io.Copy(relay, income)
-									if err != nil {
-										log.Warn(err)
-									}
-									done <- struct{}{}
-								}()
-								<-done
-							}
-						}()
+					defer income.Close()
+					lim := l.limiter()
+					if !lim.acquire() {
+						log.Warnf("Game %s reached its session limit, dropping %s", gameId, income.RemoteAddr())
+						return
 					}
+					defer lim.release()
+					g.handleTCP(income, gameId)
 				}()
-				break
-			case "UDP":
-				/*
-					established := make(map[string]network.Stream)
-					go func() {
-						for {
-							buf := make([]byte, 1024)
-							n, addr, err := listener.(net.PacketConn).ReadFrom(buf)
-							if err != nil {
-								log.Error(err)
-								return
-							}
-
-						}
-
-					}()
-					// To be implemented
-				*/
-				break
 			}
+		}()
+	case net.PacketConn:
+		go g.serveUDP(gameId, socket, l.limiter)
+	}
+}
+
+// isLocal tells if relayNodes lead to this node, which exits itself.
+func (g *gateway) isLocal(relayNodes []string) bool {
+	return len(relayNodes) == 0 || relayNodes[len(relayNodes)-1] == g.nodeId
+}
+
+// localStream returns a pipe into the exit of this node.
+func (g *gateway) localStream(game model.Game, target exit.Target) (io.ReadWriteCloser, error) {
+	if utils.IsNotAllowed(g.nodeId, game.ExitNode) {
+		return nil, fmt.Errorf("this is not allowed to relay to %s", game.ID)
+	}
+	local, remote := net.Pipe()
+	go func() {
+		err := g.exits.Handle(remote, target, nil)
+		if err != nil {
+			log.Error(err)
 		}
-		return nil
+	}()
+	return local, nil
+}
+
+// openStreams returns streams ending at the exit of the game, one for each
+// redundant route the game asks for, or a single pipe into the local exit.
+// When none of the routes can be opened, the next best routes are tried.
+func (g *gateway) openStreams(gameId string, sess *session.Session) ([]io.ReadWriteCloser, error) {
+	game := g.game(gameId)
+	routes, backend, err := g.optimize.RedundantRoutes(g.nodeId, gameId, sess.Client, int(game.Redundancy))
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Relays: %v", routes)
+	sess.SetRoute(routes[0])
+	target := exit.Target{
+		GameID:  gameId,
+		Client:  sess.Client,
+		Backend: backend,
+		Entry:   g.nodeId,
+		Session: sess.ID,
+	}
+
+	if g.isLocal(routes[0]) {
+		local, err := g.localStream(game, target)
+		if err != nil {
+			return nil, err
+		}
+		return []io.ReadWriteCloser{local}, nil
+	}
+
+	streams := make([]io.ReadWriteCloser, 0, len(routes))
+	for _, relayNodes := range routes {
+		var relay io.ReadWriteCloser
+		relay, err = relaying.OpenRelay(g.n.CTX, g.n, target, relayNodes)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		streams = append(streams, relay)
+	}
+	if len(streams) > 0 {
+		return streams, nil
 	}
 
-	n.FlushConfigCallbacks = append(n.FlushConfigCallbacks, func(c model.Config) error {
-		gameMap = make(map[string]model.Game)
-		for _, game := range c.Games {
-			gameMap[game.ID] = game
+	candidates, cerr := g.optimize.CandidateRoutes(g.nodeId, gameId, sess.Client, failoverRoutes)
+	if cerr != nil {
+		return nil, cerr
+	}
+	for _, route := range candidates {
+		if slices.ContainsFunc(routes, func(tried []string) bool { return slices.Equal(tried, route.Relays) }) {
+			continue
 		}
-		for _, listener := range listening {
-			switch listener.(type) {
-			case net.Listener:
-				listener.(net.Listener).Close()
-				break
-			case net.PacketConn:
-				listener.(net.PacketConn).Close()
-				break
+		log.Infof("Failing over to %v", route.Relays)
+		target.Backend = route.Backend
+		sess.SetRoute(route.Relays)
+		if g.isLocal(route.Relays) {
+			local, err := g.localStream(game, target)
+			if err != nil {
+				return nil, err
 			}
+			return []io.ReadWriteCloser{local}, nil
 		}
-		listening = make(map[string]interface{})
-		err := listen(c)
+		var relay io.ReadWriteCloser
+		relay, err = relaying.OpenRelay(g.n.CTX, g.n, target, route.Relays)
 		if err != nil {
-			return err
+			log.Warn(err)
+			continue
 		}
-		return nil
+		return []io.ReadWriteCloser{relay}, nil
+	}
+	return nil, err
+}
+
+// handleTCP relays one accepted connection until either side closes it.
+// The candidate routes are tried in order until one can be opened.
+func (g *gateway) handleTCP(income net.Conn, gameId string) {
+	sess := g.sessions.Open(income.RemoteAddr().String(), gameId, func() {
+		income.Close()
 	})
+	defer g.sessions.Close(sess)
+	client := sess.Wrap(income)
 
-	err := listen(*n.Config)
+	game := g.game(gameId)
+	routes, err := g.optimize.CandidateRoutes(g.nodeId, gameId, sess.Client, failoverRoutes)
 	if err != nil {
-		return err
+		log.Warn(err)
+		return
+	}
+	target := exit.Target{GameID: gameId, Client: sess.Client, Entry: g.nodeId}
+
+	var proxyHeader *proxyproto.Header
+	if game.Protocol == "HAProxy" {
+		log.Info(income.RemoteAddr().(*net.TCPAddr).IP)
+		proxyHeader = proxyproto.HeaderProxyFromAddrs(2, income.RemoteAddr(), income.LocalAddr())
+	}
+
+	var conn *tunnel.Conn
+	var relayNodes []string
+	for _, route := range routes {
+		log.Infof("Relays: %v", route.Relays)
+		sess.SetRoute(route.Relays)
+		target.Backend = route.Backend
+
+		if g.isLocal(route.Relays) {
+			if utils.IsNotAllowed(g.nodeId, game.ExitNode) {
+				log.Warnf("This is not allowed to relay to %s", gameId)
+				continue
+			}
+			var extraSend interface{}
+			if proxyHeader != nil {
+				extraSend = func(conn net.Conn) error {
+					_, err := proxyHeader.WriteTo(conn)
+					return err
+				}
+			}
+			err := g.exits.Handle(client, target, extraSend)
+			if err != nil {
+				log.Error(err)
+			}
+			return
+		}
+
+		if conn == nil {
+			conn = tunnel.NewConn(resumeTimeout)
+			defer conn.Close()
+		}
+		relayTarget := target
+		relayTarget.Session = sess.ID
+		err := g.attach(conn, relayTarget, route.Relays)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+		target = relayTarget
+		relayNodes = route.Relays
+		break
 	}
+	if relayNodes == nil {
+		log.Errorf("No route to %s could be opened", gameId)
+		return
+	}
+	go g.migrate(conn, sess, target, relayNodes)
+
+	if proxyHeader != nil {
+		_, err := proxyHeader.WriteTo(conn)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
 
-	return nil
+	go func() {
+		_, err := io.Copy(client, conn)
+		if err != nil {
+			log.Warn(err)
+		}
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, err := io.Copy(conn, client)
+		if err != nil {
+			log.Warn(err)
+		}
+		done <- struct{}{}
+	}()
+	<-done
 }
@@ -0,0 +1,68 @@
+package entry
+
+import "time"
+
+// backlogTimeout is how long a connection may wait for a free session slot.
+const backlogTimeout = 10 * time.Second
+
+// limiter caps the concurrent sessions of a game. Connections over the cap
+// wait in a bounded backlog and are shed once it is full or they time out.
+// A nil limiter does not limit anything.
+type limiter struct {
+	slots   chan struct{}
+	backlog chan struct{}
+}
+
+func newLimiter(maxSessions uint64, backlog uint64) *limiter {
+	if maxSessions == 0 {
+		return nil
+	}
+	return &limiter{
+		slots:   make(chan struct{}, maxSessions),
+		backlog: make(chan struct{}, backlog),
+	}
+}
+
+// tryAcquire takes a slot without waiting.
+func (l *limiter) tryAcquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire takes a slot, waiting in the backlog if there is room in it.
+func (l *limiter) acquire() bool {
+	if l.tryAcquire() {
+		return true
+	}
+	select {
+	case l.backlog <- struct{}{}:
+	default:
+		return false
+	}
+	defer func() {
+		<-l.backlog
+	}()
+
+	timer := time.NewTimer(backlogTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (l *limiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.slots
+}
@@ -0,0 +1,72 @@
+package entry
+
+import (
+	"fmt"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// listener is the socket an entry node binds for one game.
+type listener struct {
+	network string
+	address string
+	socket  io.Closer
+
+	lim    atomic.Pointer[limiter]
+	limits [2]uint64
+}
+
+// networkOf maps a game protocol to the network its players connect with.
+func networkOf(protocol string) string {
+	switch protocol {
+	case "TCP", "HAProxy":
+		return "tcp"
+	case "UDP":
+		return "udp"
+	}
+	return ""
+}
+
+func newListener(game model.Game, host string) (*listener, error) {
+	l := &listener{
+		network: networkOf(game.Protocol),
+		address: fmt.Sprintf("%s:%d", host, game.ListenPort),
+	}
+	var err error
+	switch l.network {
+	case "tcp":
+		l.socket, err = net.Listen(l.network, l.address)
+	case "udp":
+		l.socket, err = net.ListenPacket(l.network, l.address)
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", game.Protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.limits = [2]uint64{game.MaxSessions, game.AcceptBacklog}
+	l.lim.Store(newLimiter(game.MaxSessions, game.AcceptBacklog))
+	return l, nil
+}
+
+// matches reports whether the listener can keep serving game unchanged.
+func (l *listener) matches(game model.Game, host string) bool {
+	return l.network == networkOf(game.Protocol) && l.address == fmt.Sprintf("%s:%d", host, game.ListenPort)
+}
+
+// setLimits swaps in a new limiter when the limits changed. Sessions that
+// hold a slot of the old limiter release it there.
+func (l *listener) setLimits(maxSessions uint64, backlog uint64) {
+	limits := [2]uint64{maxSessions, backlog}
+	if l.limits == limits {
+		return
+	}
+	l.limits = limits
+	l.lim.Store(newLimiter(maxSessions, backlog))
+}
+
+func (l *listener) limiter() *limiter {
+	return l.lim.Load()
+}
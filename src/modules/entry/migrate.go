@@ -0,0 +1,104 @@
+package entry
+
+import (
+	"github.com/GlazeLab/PureGamer/src/modules/exit"
+	"github.com/GlazeLab/PureGamer/src/modules/relaying"
+	"github.com/GlazeLab/PureGamer/src/modules/session"
+	"github.com/GlazeLab/PureGamer/src/modules/tunnel"
+	"slices"
+	"time"
+)
+
+const (
+	// resumeTimeout is how long a session may go without a route before the
+	// player is disconnected.
+	resumeTimeout = 30 * time.Second
+	// migrateInterval is how often a session looks for a better route.
+	migrateInterval = 5 * time.Second
+)
+
+// attach opens a relay stream over relayNodes and moves conn onto it.
+func (g *gateway) attach(conn *tunnel.Conn, target exit.Target, relayNodes []string) error {
+	relay, err := relaying.OpenRelay(g.n.CTX, g.n, target, relayNodes)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Resume(relay)
+	if err != nil {
+		relay.Close()
+		return err
+	}
+	return nil
+}
+
+// migrate moves conn to another route to the same exit node when its route
+// breaks, or when the optimizer switches the game to another route. Routes
+// are taken from the candidates of the optimizer, so that migrations keep to
+// the pinned routes, strategy and hysteresis of the game.
+func (g *gateway) migrate(conn *tunnel.Conn, sess *session.Session, target exit.Target, relayNodes []string) {
+	exitNode := relayNodes[len(relayNodes)-1]
+	ticker := time.NewTicker(migrateInterval)
+	defer ticker.Stop()
+	broken := false
+	for {
+		select {
+		case <-conn.Done():
+			return
+		case <-conn.Broken():
+			broken = true
+		case <-ticker.C:
+		}
+
+		candidate := g.moveTo(target, exitNode, relayNodes, broken)
+		if candidate == nil {
+			if !broken {
+				continue
+			}
+			// retry the old route, the graph may not know better yet
+			candidate = relayNodes
+		}
+
+		log.Infof("Session %s moves from %v to %v", sess.ID, relayNodes, candidate)
+		err := g.attach(conn, target, candidate)
+		if err != nil {
+			log.Warn(err)
+			if broken {
+				// try again on the next tick
+				ticker.Reset(time.Second)
+			}
+			continue
+		}
+		broken = false
+		relayNodes = candidate
+		sess.SetRoute(relayNodes)
+		ticker.Reset(migrateInterval)
+	}
+}
+
+// moveTo returns the route a session over relayNodes should move to, or nil
+// when it should stay. Only routes to the same exit node and backend can
+// take the session over. A working session follows the route the optimizer
+// chose, a broken one takes the first other candidate.
+func (g *gateway) moveTo(target exit.Target, exitNode string, relayNodes []string, broken bool) []string {
+	routes, err := g.optimize.CandidateRoutes(g.nodeId, target.GameID, target.Client, failoverRoutes)
+	if err != nil {
+		log.Warn(err)
+		return nil
+	}
+	for i, route := range routes {
+		if !broken && i > 0 {
+			return nil
+		}
+		if len(route.Relays) == 0 || route.Relays[len(route.Relays)-1] != exitNode || route.Backend != target.Backend {
+			continue
+		}
+		if slices.Equal(route.Relays, relayNodes) {
+			if !broken {
+				return nil
+			}
+			continue
+		}
+		return route.Relays
+	}
+	return nil
+}
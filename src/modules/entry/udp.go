@@ -0,0 +1,251 @@
+package entry
+
+import (
+	"errors"
+	"github.com/GlazeLab/PureGamer/src/modules/session"
+	"github.com/GlazeLab/PureGamer/src/modules/tunnel"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// udpSessionTimeout expires a client address after this long without traffic.
+	udpSessionTimeout = time.Minute
+	// udpQueueSize is how many datagrams may wait for the relay to be opened.
+	udpQueueSize = 64
+	// udpKickBlock is how long the datagrams of a kicked client address are
+	// dropped, instead of opening a new session.
+	udpKickBlock = time.Minute
+)
+
+// udpSession carries the datagrams of one client address to the exit node.
+type udpSession struct {
+	addr     net.Addr
+	sess     *session.Session
+	queue    chan []byte
+	lastSeen atomic.Int64
+	done     chan struct{}
+	once     sync.Once
+}
+
+func newUDPSession(addr net.Addr) *udpSession {
+	s := &udpSession{
+		addr:  addr,
+		queue: make(chan []byte, udpQueueSize),
+		done:  make(chan struct{}),
+	}
+	s.touch()
+	return s
+}
+
+func (s *udpSession) touch() {
+	s.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idle(now time.Time) bool {
+	return now.Sub(time.Unix(0, s.lastSeen.Load())) > udpSessionTimeout
+}
+
+func (s *udpSession) close() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// run opens the streams to the exit node and pumps datagrams both ways until
+// the session is closed or all of its streams failed. Every datagram is sent
+// over all the streams, and the first copy of a reply wins.
+func (s *udpSession) run(conn net.PacketConn, open func(*session.Session) ([]io.ReadWriteCloser, error)) {
+	defer s.close()
+	streams, err := open(s.sess)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer func() {
+		for _, stream := range streams {
+			if stream != nil {
+				stream.Close()
+			}
+		}
+	}()
+
+	var window tunnel.Window
+	var alive atomic.Int64
+	alive.Store(int64(len(streams)))
+	for _, stream := range streams {
+		go func(stream io.ReadWriteCloser) {
+			defer func() {
+				if alive.Add(-1) == 0 {
+					s.close()
+				}
+			}()
+			buf := make([]byte, tunnel.MaxFrameSize)
+			for {
+				seq, datagram, err := tunnel.ReadDatagram(stream, buf)
+				if err != nil {
+					if !errors.Is(err, io.EOF) {
+						log.Warn(err)
+					}
+					return
+				}
+				s.touch()
+				if !window.Fresh(seq) {
+					continue
+				}
+				s.sess.AddDown(len(datagram))
+				_, err = conn.WriteTo(datagram, s.addr)
+				if err != nil {
+					log.Warn(err)
+					return
+				}
+			}
+		}(stream)
+	}
+
+	var seq uint64
+	for {
+		select {
+		case packet := <-s.queue:
+			seq++
+			s.sess.AddUp(len(packet))
+			sent := false
+			for i, stream := range streams {
+				if stream == nil {
+					continue
+				}
+				err = tunnel.WriteDatagram(stream, seq, packet)
+				if err != nil {
+					log.Warn(err)
+					stream.Close()
+					streams[i] = nil
+					continue
+				}
+				sent = true
+			}
+			if !sent {
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// serveUDP demultiplexes datagrams by client address into sessions, each of
+// them relayed over its own stream, until conn is closed.
+func (g *gateway) serveUDP(gameId string, conn net.PacketConn, limits func() *limiter) {
+	open := func(sess *session.Session) ([]io.ReadWriteCloser, error) {
+		return g.openStreams(gameId, sess)
+	}
+
+	sessions := make(map[string]*udpSession)
+	// kicked holds until when the client addresses kicked are blocked
+	kicked := make(map[string]time.Time)
+	var lock sync.Mutex
+
+	stop := make(chan struct{})
+	defer func() {
+		close(stop)
+		lock.Lock()
+		defer lock.Unlock()
+		for _, s := range sessions {
+			s.close()
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(udpSessionTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				lock.Lock()
+				for key, s := range sessions {
+					select {
+					case <-s.done:
+						delete(sessions, key)
+						continue
+					default:
+					}
+					if s.idle(now) {
+						log.Infof("UDP session from %s expired", s.addr)
+						s.close()
+						delete(sessions, key)
+					}
+				}
+				for key, until := range kicked {
+					if now.After(until) {
+						delete(kicked, key)
+					}
+				}
+				lock.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		size, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Error(err)
+			}
+			return
+		}
+
+		key := addr.String()
+		lock.Lock()
+		s, ok := sessions[key]
+		if ok {
+			select {
+			case <-s.done:
+				ok = false
+			default:
+			}
+		}
+		if !ok && time.Now().Before(kicked[key]) {
+			lock.Unlock()
+			continue
+		}
+		if !ok {
+			lim := limits()
+			if !lim.tryAcquire() {
+				lock.Unlock()
+				log.Warnf("Session limit reached, dropping datagram from %s", addr)
+				continue
+			}
+			log.Infof("New UDP session from %s", addr)
+			s = newUDPSession(addr)
+			s.sess = g.sessions.Open(key, gameId, func() {
+				// UDP has no connection to close, the client would open a new
+				// session with its next datagram
+				lock.Lock()
+				kicked[key] = time.Now().Add(udpKickBlock)
+				lock.Unlock()
+				s.close()
+			})
+			sessions[key] = s
+			go func(s *udpSession) {
+				defer lim.release()
+				defer g.sessions.Close(s.sess)
+				s.run(conn, open)
+			}(s)
+		}
+		lock.Unlock()
+
+		s.touch()
+		packet := make([]byte, size)
+		copy(packet, buf[:size])
+		select {
+		case s.queue <- packet:
+		default:
+			// the relay is not keeping up, drop like a congested link would
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package exit
+
+import (
+	"github.com/GlazeLab/PureGamer/src/model"
+	"hash/fnv"
+	"math"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+// backend keeps the health and load of one backend of a game.
+type backend struct {
+	model.Backend
+	address  string
+	up       atomic.Bool
+	failures atomic.Int64
+	conns    atomic.Int64
+	latency  atomic.Int64
+}
+
+func (b *backend) weight() float64 {
+	if b.Weight == 0 {
+		return 1
+	}
+	return float64(b.Weight)
+}
+
+// balancer chooses a backend of a game for every new session.
+type balancer struct {
+	backends []model.Backend
+	servers  []*backend
+	next     atomic.Uint64
+}
+
+func newBalancer(backends []model.Backend) *balancer {
+	b := &balancer{backends: backends}
+	for _, server := range backends {
+		s := &backend{Backend: server, address: server.Address()}
+		s.up.Store(true)
+		b.servers = append(b.servers, s)
+	}
+	return b
+}
+
+func (b *balancer) sameBackends(backends []model.Backend) bool {
+	return reflect.DeepEqual(b.backends, backends)
+}
+
+// healthy returns the backends that are up, or all of them if none is, as
+// trying a backend that is down beats refusing the player.
+func (b *balancer) healthy() []*backend {
+	servers := make([]*backend, 0, len(b.servers))
+	for _, s := range b.servers {
+		if s.up.Load() {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		return b.servers
+	}
+	return servers
+}
+
+// pick chooses a backend with the given strategy. preferred is the backend
+// the route was optimized for and client is the address of the player.
+func (b *balancer) pick(strategy string, client string, preferred string) *backend {
+	servers := b.healthy()
+	if len(servers) == 1 {
+		return servers[0]
+	}
+	switch strategy {
+	case "round-robin":
+		return roundRobin(servers, b.next.Add(1))
+	case "least-conn":
+		return leastConn(servers)
+	case "hash":
+		return rendezvous(servers, client)
+	default:
+		for _, s := range servers {
+			if s.address == preferred {
+				return s
+			}
+		}
+		return fastest(servers)
+	}
+}
+
+func roundRobin(servers []*backend, n uint64) *backend {
+	var total float64
+	for _, s := range servers {
+		total += s.weight()
+	}
+	point := math.Mod(float64(n), total)
+	for _, s := range servers {
+		point -= s.weight()
+		if point < 0 {
+			return s
+		}
+	}
+	return servers[len(servers)-1]
+}
+
+func leastConn(servers []*backend) *backend {
+	best := servers[0]
+	for _, s := range servers[1:] {
+		if float64(s.conns.Load())/s.weight() < float64(best.conns.Load())/best.weight() {
+			best = s
+		}
+	}
+	return best
+}
+
+// rendezvous hashes the client IP with every backend and takes the highest
+// weighted score, so a client sticks to its backend and only the clients of
+// a backend that goes away are moved.
+func rendezvous(servers []*backend, client string) *backend {
+	ip, _, err := net.SplitHostPort(client)
+	if err != nil {
+		ip = client
+	}
+	var best *backend
+	bestScore := math.Inf(-1)
+	for _, s := range servers {
+		h := fnv.New64a()
+		h.Write([]byte(ip))
+		h.Write([]byte(s.address))
+		u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+		score := -s.weight() / math.Log(u)
+		if score > bestScore {
+			best, bestScore = s, score
+		}
+	}
+	return best
+}
+
+// fastest returns the backend with the lowest probed latency.
+func fastest(servers []*backend) *backend {
+	best := servers[0]
+	for _, s := range servers[1:] {
+		latency := s.latency.Load()
+		if latency > 0 && (best.latency.Load() == 0 || latency < best.latency.Load()) {
+			best = s
+		}
+	}
+	return best
+}
+
+func (b *backend) report(latency time.Duration, err error) {
+	if err != nil {
+		if b.failures.Add(1) >= healthFailures && b.up.Swap(false) {
+			log.Warnf("Backend %s is down: %s", b.address, err)
+		}
+		return
+	}
+	b.failures.Store(0)
+	b.latency.Store(int64(latency))
+	if !b.up.Swap(true) {
+		log.Infof("Backend %s is up again", b.address)
+	}
+}
@@ -1,46 +1,104 @@
 package exit
 
 import (
-	"fmt"
 	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/modules/tunnel"
 	logging "github.com/ipfs/go-log/v2"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
 var log = logging.Logger("exit")
 
 type Exit struct {
-	gameMap map[string]model.Game
+	lock      sync.RWMutex
+	gameMap   map[string]model.Game
+	balancers map[string]*balancer
+	groups    map[string]*udpGroup
+	resumable map[string]*tunnel.Conn
+}
+
+// Target tells the exit where a stream should go.
+type Target struct {
+	GameID string
+	// Client is the address of the player, used to balance by client IP.
+	Client string
+	// Backend is the address of the backend the route was optimized for.
+	Backend string
+	// Entry is the entry node of the stream.
+	Entry string
+	// Session is set by the entry node for the streams it can move to another
+	// route: TCP sessions that resume, and the redundant streams of UDP sessions.
+	Session string
 }
 
 func NewExit(n *model.Node) (*Exit, error) {
 	exitNode := &Exit{
-		gameMap: make(map[string]model.Game),
-	}
-	for _, game := range n.Config.Games {
-		exitNode.gameMap[game.ID] = game
+		gameMap:   make(map[string]model.Game),
+		balancers: make(map[string]*balancer),
+		groups:    make(map[string]*udpGroup),
+		resumable: make(map[string]*tunnel.Conn),
 	}
+	exitNode.flush(*n.Config)
 	n.FlushConfigCallbacks = append(n.FlushConfigCallbacks, func(c model.Config) error {
-		exitNode.gameMap = make(map[string]model.Game)
-		for _, game := range c.Games {
-			exitNode.gameMap[game.ID] = game
-		}
+		exitNode.flush(c)
 		return nil
 	})
+	go exitNode.checkHealth(n.CTX, n.Host.ID().String())
 	return exitNode, nil
 }
 
-func (e *Exit) Handle(s io.ReadWriteCloser, gameId string, extraSend interface{}) error {
+// flush loads a new config, keeping the health of backends that did not change.
+func (e *Exit) flush(c model.Config) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	gameMap := make(map[string]model.Game)
+	balancers := make(map[string]*balancer)
+	for _, game := range c.Games {
+		gameMap[game.ID] = game
+		servers := game.Servers()
+		if b, ok := e.balancers[game.ID]; ok && b.sameBackends(servers) {
+			balancers[game.ID] = b
+		} else {
+			balancers[game.ID] = newBalancer(servers)
+		}
+	}
+	e.gameMap = gameMap
+	e.balancers = balancers
+}
+
+// Game returns the configuration of the game with the given ID.
+func (e *Exit) Game(gameId string) (model.Game, bool) {
+	e.lock.RLock()
+	defer e.lock.RUnlock()
 	game, ok := e.gameMap[gameId]
+	return game, ok
+}
+
+func (e *Exit) Handle(s io.ReadWriteCloser, target Target, extraSend interface{}) error {
+	e.lock.RLock()
+	game, ok := e.gameMap[target.GameID]
+	b := e.balancers[target.GameID]
+	e.lock.RUnlock()
 	if !ok {
 		return nil
 	}
 	defer s.Close()
+
 	switch game.Protocol {
 	case "TCP", "HAProxy":
-		conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", game.Host, game.Port), time.Duration(10)*time.Second)
+		if target.Session != "" {
+			return e.handleResumable(s, target, game, b)
+		}
+
+		server := b.pick(game.Balance, target.Client, target.Backend)
+		server.conns.Add(1)
+		defer server.conns.Add(-1)
+		log.Infof("Exit to backend %s of %s", server.address, game.ID)
+
+		conn, err := net.DialTimeout("tcp", server.address, time.Duration(10)*time.Second)
 		if err != nil {
 			return err
 		}
@@ -74,6 +132,8 @@ func (e *Exit) Handle(s io.ReadWriteCloser, gameId string, extraSend interface{}
 
 		<-done
 		break
+	case "UDP":
+		return e.handleUDP(s, target, game, b)
 	}
 
 	return nil
@@ -0,0 +1,62 @@
+package exit
+
+import (
+	"context"
+	"github.com/GlazeLab/PureGamer/src/modules/pinging"
+	"github.com/GlazeLab/PureGamer/src/utils"
+	"sync"
+	"time"
+)
+
+const (
+	healthInterval = 10 * time.Second
+	// healthFailures is how many probes in a row must fail to mark a backend down.
+	healthFailures = 3
+)
+
+// probe checks a backend with a single probe of the speed test protocol of
+// its game. The speed test measures it more closely, less often.
+func probe(protocol string, b *backend) (time.Duration, bool, error) {
+	switch protocol {
+	case "ICMP":
+		latency, err := pinging.ProbeICMP(b.Host, b.Port)
+		return latency.Duration(), true, err
+	case "TCP":
+		latency, err := pinging.ProbeTCP(b.Host, b.Port)
+		return latency.Duration(), true, err
+	}
+	return 0, false, nil
+}
+
+// checkHealth probes the backends of the games this node exits until ctx is done.
+func (e *Exit) checkHealth(ctx context.Context, nodeId string) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			e.lock.RLock()
+			for gameId, b := range e.balancers {
+				game := e.gameMap[gameId]
+				if utils.IsNotAllowed(nodeId, game.ExitNode) {
+					continue
+				}
+				for _, s := range b.servers {
+					wg.Add(1)
+					go func(protocol string, s *backend) {
+						defer wg.Done()
+						latency, probed, err := probe(protocol, s)
+						if probed {
+							s.report(latency, err)
+						}
+					}(game.SpeedTestProtocol, s)
+				}
+			}
+			e.lock.RUnlock()
+			wg.Wait()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package exit
+
+import (
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/modules/tunnel"
+	"io"
+	"net"
+	"time"
+)
+
+// resumeTimeout is how long a TCP session waits for its entry node to come
+// back over another route before the game server connection is closed.
+const resumeTimeout = 30 * time.Second
+
+// handleResumable attaches s to the TCP session of its entry node, starting
+// the session on its first stream, and returns when s stops carrying it.
+func (e *Exit) handleResumable(s io.ReadWriteCloser, target Target, game model.Game, b *balancer) error {
+	id := target.Entry + "/" + target.Session
+	e.lock.Lock()
+	conn, ok := e.resumable[id]
+	if !ok {
+		conn = tunnel.NewConn(resumeTimeout)
+		e.resumable[id] = conn
+		go e.serveResumable(id, conn, target, game, b)
+	}
+	e.lock.Unlock()
+
+	detached, err := conn.Resume(s)
+	if err != nil {
+		return err
+	}
+	if ok {
+		log.Infof("Session %s resumed", id)
+	}
+	<-detached
+	return nil
+}
+
+// serveResumable connects the session to a backend until either side closes.
+func (e *Exit) serveResumable(id string, conn *tunnel.Conn, target Target, game model.Game, b *balancer) {
+	defer func() {
+		e.lock.Lock()
+		if e.resumable[id] == conn {
+			delete(e.resumable, id)
+		}
+		e.lock.Unlock()
+	}()
+	defer conn.Close()
+
+	server := b.pick(game.Balance, target.Client, target.Backend)
+	server.conns.Add(1)
+	defer server.conns.Add(-1)
+	log.Infof("Exit to backend %s of %s", server.address, game.ID)
+
+	backendConn, err := net.DialTimeout("tcp", server.address, time.Duration(10)*time.Second)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer backendConn.Close()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		_, err := io.Copy(backendConn, conn)
+		if err != nil {
+			log.Warn(err)
+		}
+		done <- struct{}{}
+	}()
+
+	go func() {
+		_, err := io.Copy(conn, backendConn)
+		if err != nil {
+			log.Warn(err)
+		}
+		done <- struct{}{}
+	}()
+
+	<-done
+}
@@ -0,0 +1,166 @@
+package exit
+
+import (
+	"errors"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/modules/tunnel"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// udpIdleTimeout closes a UDP session when neither side has sent anything
+// for this long. The entry normally expires sessions first.
+const udpIdleTimeout = 2 * time.Minute
+
+// udpGroup is the socket to the backend of one UDP session, shared by the
+// streams of its redundant paths. Datagrams from the player are delivered
+// once whichever path brings them first, and replies go out on every path.
+type udpGroup struct {
+	id       string
+	conn     net.Conn
+	server   *backend
+	window   tunnel.Window
+	seq      atomic.Uint64
+	lastSeen atomic.Int64
+
+	lock    sync.Mutex
+	streams map[io.ReadWriteCloser]struct{}
+}
+
+func (g *udpGroup) touch() {
+	g.lastSeen.Store(time.Now().UnixNano())
+}
+
+func (g *udpGroup) members() []io.ReadWriteCloser {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	streams := make([]io.ReadWriteCloser, 0, len(g.streams))
+	for s := range g.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// joinGroup adds s to the group of its session, dialing the backend when
+// s is the first stream of the session.
+func (e *Exit) joinGroup(s io.ReadWriteCloser, target Target, game model.Game, b *balancer) (*udpGroup, error) {
+	id := ""
+	if target.Session != "" {
+		id = target.Entry + "/" + target.Session
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if group, ok := e.groups[id]; ok && id != "" {
+		group.lock.Lock()
+		group.streams[s] = struct{}{}
+		group.lock.Unlock()
+		return group, nil
+	}
+
+	server := b.pick(game.Balance, target.Client, target.Backend)
+	log.Infof("Exit to backend %s of %s", server.address, game.ID)
+	conn, err := net.Dial("udp", server.address)
+	if err != nil {
+		return nil, err
+	}
+	server.conns.Add(1)
+	group := &udpGroup{
+		id:      id,
+		conn:    conn,
+		server:  server,
+		streams: map[io.ReadWriteCloser]struct{}{s: {}},
+	}
+	group.touch()
+	if group.id != "" {
+		e.groups[group.id] = group
+	}
+	go group.reply()
+	return group, nil
+}
+
+// leaveGroup removes s from the group and closes the group with its last stream.
+func (e *Exit) leaveGroup(group *udpGroup, s io.ReadWriteCloser) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	group.lock.Lock()
+	delete(group.streams, s)
+	left := len(group.streams)
+	group.lock.Unlock()
+	if left > 0 {
+		return
+	}
+	group.conn.Close()
+	group.server.conns.Add(-1)
+	if e.groups[group.id] == group {
+		delete(e.groups, group.id)
+	}
+}
+
+// reply sends the datagrams of the backend to every stream of the group
+// until the socket is closed or idle.
+func (g *udpGroup) reply() {
+	defer func() {
+		for _, s := range g.members() {
+			s.Close()
+		}
+	}()
+	buf := make([]byte, tunnel.MaxDatagramSize)
+	for {
+		err := g.conn.SetReadDeadline(time.Now().Add(udpIdleTimeout))
+		if err != nil {
+			log.Warn(err)
+			return
+		}
+		size, err := g.conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() &&
+				time.Since(time.Unix(0, g.lastSeen.Load())) < udpIdleTimeout {
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warn(err)
+			}
+			return
+		}
+		g.touch()
+		seq := g.seq.Add(1)
+		for _, s := range g.members() {
+			err = tunnel.WriteDatagram(s, seq, buf[:size])
+			if err != nil {
+				log.Warn(err)
+			}
+		}
+	}
+}
+
+func (e *Exit) handleUDP(s io.ReadWriteCloser, target Target, game model.Game, b *balancer) error {
+	group, err := e.joinGroup(s, target, game, b)
+	if err != nil {
+		return err
+	}
+	defer e.leaveGroup(group, s)
+
+	buf := make([]byte, tunnel.MaxFrameSize)
+	for {
+		seq, datagram, err := tunnel.ReadDatagram(s, buf)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Warn(err)
+			}
+			return nil
+		}
+		group.touch()
+		if !group.window.Fresh(seq) {
+			continue
+		}
+		_, err = group.conn.Write(datagram)
+		if err != nil {
+			log.Warn(err)
+			return nil
+		}
+	}
+}
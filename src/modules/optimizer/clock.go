@@ -0,0 +1,42 @@
+package optimizer
+
+import (
+	"sync"
+	"time"
+)
+
+// clockSmoothing is the weight of a new estimate of a clock offset.
+const clockSmoothing = 0.25
+
+// clocks tracks how far the clock of each peer is ahead of this node. Each
+// round gives an estimate, which is smoothed with the earlier ones.
+type clocks struct {
+	lock    sync.Mutex
+	offsets map[string]time.Duration
+}
+
+func newClocks() *clocks {
+	return &clocks{offsets: make(map[string]time.Duration)}
+}
+
+// update adds an estimate of the offset of the peer and returns the
+// smoothed offset.
+func (c *clocks) update(peerId string, estimate time.Duration) time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	offset, ok := c.offsets[peerId]
+	if !ok {
+		offset = estimate
+	} else {
+		offset += time.Duration(clockSmoothing * float64(estimate-offset))
+	}
+	c.offsets[peerId] = offset
+	return offset
+}
+
+// forget drops the offset of a peer that left.
+func (c *clocks) forget(peerId string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.offsets, peerId)
+}
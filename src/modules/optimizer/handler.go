@@ -2,12 +2,20 @@ package optimizer
 
 import (
 	"context"
+	"fmt"
 	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/utils"
 	"github.com/vmihailenco/msgpack/v5"
+	"slices"
+	"time"
 )
 
 func (o *Optimizer) Handle(ctx context.Context) <-chan error {
 	errCh := make(chan error)
+	go o.expire(ctx)
+	if o.n.Store != nil {
+		go o.snapshot(ctx)
+	}
 	go func() {
 		for {
 			msg, err := o.sub.Next(ctx)
@@ -16,19 +24,48 @@ func (o *Optimizer) Handle(ctx context.Context) <-chan error {
 				errCh <- err
 				continue
 			}
-			var latencies model.Latencies
-			err = msgpack.Unmarshal(msg.GetData(), &latencies)
+			var report model.Report
+			err = msgpack.Unmarshal(msg.GetData(), &report)
 			if err != nil {
 				log.Error(err)
 				errCh <- err
 				continue
 			}
 			fromNode := msg.GetFrom().String()
+			o.lock.Lock()
+			o.seen[fromNode] = time.Now()
+			o.lock.Unlock()
+			latencies := report.Latencies
+			o.gr.SetLoad(fromNode, float64(report.Load))
+
+			// backends lead to their game for free, the exit node pays
+			// the latency to the backend
+			for to := range latencies {
+				if _, _, ok := model.ParseBackendVertex(to); !ok {
+					continue
+				}
+				gameId, ok := o.exitsTo(fromNode, to)
+				if !ok {
+					log.Warnf("%s reports backend %s it may not exit to", fromNode, to)
+					delete(latencies, to)
+					continue
+				}
+				o.gr.AddEdge(to, gameId, 0)
+			}
+
+			o.lock.Lock()
+			for to, latency := range report.Reverse {
+				o.measured[[2]string{to, fromNode}] = latency
+			}
+			o.lock.Unlock()
+			for to, latency := range latencies {
+				latencies[to] = o.sane(fromNode, to, latency)
+			}
 
 			existEdges := o.gr.IterateEdges(fromNode)
 			for _, to := range existEdges {
 				if latency, ok := latencies[to]; ok {
-					o.gr.AddEdge(fromNode, to, latency)
+					o.gr.AddLink(fromNode, to, latency)
 					delete(latencies, to)
 				} else {
 					o.gr.RemoveEdge(fromNode, to)
@@ -39,7 +76,7 @@ func (o *Optimizer) Handle(ctx context.Context) <-chan error {
 				}
 			}
 			for to, latency := range latencies {
-				o.gr.AddEdge(fromNode, to, latency)
+				o.gr.AddLink(fromNode, to, latency)
 			}
 
 		}
@@ -47,10 +84,177 @@ func (o *Optimizer) Handle(ctx context.Context) <-chan error {
 	return errCh
 }
 
+// exitsTo tells if node may exit to vertex, a backend of a configured game,
+// and returns the game. Backends have no way back to check a claim against,
+// so only the exit nodes of the game are trusted with them.
+func (o *Optimizer) exitsTo(node string, vertex string) (string, bool) {
+	gameId, address, _ := model.ParseBackendVertex(vertex)
+	game, ok := o.game(gameId)
+	if !ok || utils.IsNotAllowed(node, game.ExitNode) {
+		return "", false
+	}
+	return gameId, slices.ContainsFunc(game.Servers(), func(backend model.Backend) bool {
+		return backend.Address() == address
+	})
+}
+
+// sane checks a link a node reports against what the other end measures. With
+// round trips, that is the way back, as both ends measure the same round
+// trip. With one-way delays, the other end reports the delay of the link
+// itself. A claim much better than what the other end sees is replaced by
+// the measurement of the latter.
+func (o *Optimizer) sane(from string, to string, claimed model.Latency) model.Latency {
+	var other model.Latency
+	if o.n.Config.System.OneWayDelay != "" {
+		o.lock.Lock()
+		other = o.measured[[2]string{from, to}]
+		o.lock.Unlock()
+	} else if reverse, ok := o.gr.FindEdge(to, from); ok {
+		other = reverse.Latency
+	}
+	if other == (model.Latency{}) || claimed.Mean*reverseRatio+reverseSlack >= other.Mean {
+		return claimed
+	}
+	log.Warnf("%s claims %s to %s, which measures %s", from, claimed, to, other)
+	return other
+}
+
 func (o *Optimizer) OptimizedRoutes(entry string, exit string) []string {
-	log.Infof("Entry: %s, Exit: %s", entry, exit)
+	routes, _, _ := o.OptimizedRoute(entry, exit, "")
+	return routes
+}
+
+// OptimizedRoute returns the relay nodes from entry to the exit node of the
+// game, chosen by the routing strategy of the game for client, and the
+// address of the backend the exit node should connect to. It fails with
+// ErrUnreachable when the strategy finds no route and the game must not be
+// exited elsewhere, as no relay nodes would mean exiting at entry.
+func (o *Optimizer) OptimizedRoute(entry string, game string, client string) ([]string, string, error) {
+	log.Infof("Entry: %s, Exit: %s", entry, game)
 	log.Infof("%v", o.gr.IterateEdges(entry))
-	routes, dist := o.gr.ShortestPath(entry, exit)
+	conf, _ := o.game(game)
+	o.lock.Lock()
+	var current []string
+	if state, ok := o.routes[entry+"/"+game]; ok {
+		current = state.path
+	}
+	o.lock.Unlock()
+	ctx := RouteContext{
+		Entry:   entry,
+		Game:    conf,
+		Client:  client,
+		Current: current,
+	}
+
+	routes, dist := pinned(o.gr, ctx)
+	if routes != nil {
+		log.Infof("Pinned: %f", dist)
+		o.pin(entry, game, routes)
+		relays, backend := splitBackend(routes)
+		return relays, backend, nil
+	}
+	if len(conf.PinnedRoutes) > 0 && conf.Strategy != PinnedStrategy {
+		log.Warnf("No pinned route of %s is healthy, routing automatically", game)
+	}
+
+	strategy := strategyOf(conf)
+	if len(conf.PreferExits) > 0 {
+		preferred := ctx
+		preferred.Exits = conf.PreferExits
+		routes, dist = strategy.Route(o.gr, preferred)
+	}
+	if routes == nil {
+		routes, dist = strategy.Route(o.gr, ctx)
+	}
 	log.Infof("Optimized: %f", dist)
-	return routes
+	routes = o.stable(entry, game, routes, dist)
+	if _, ok := strategy.(pinnedStrategy); ok && routes == nil {
+		return nil, "", fmt.Errorf("%w: no pinned route of %s is healthy", ErrUnreachable, game)
+	}
+	relays, backend := splitBackend(routes)
+	return relays, backend, nil
+}
+
+// splitBackend takes the backend vertex off the end of a path to a game.
+func splitBackend(path []string) ([]string, string) {
+	if len(path) == 0 {
+		return path, ""
+	}
+	_, backend, ok := model.ParseBackendVertex(path[len(path)-1])
+	if ok {
+		path = path[:len(path)-1]
+	}
+	return path, backend
+}
+
+// Route is a way from an entry node to a game: the relay nodes, ending with
+// the exit node, and the backend the exit node should connect to.
+type Route struct {
+	Relays  []string
+	Backend string
+}
+
+// CandidateRoutes returns up to k routes from entry to the game to try in
+// order, starting with the one of OptimizedRoute and followed, when the
+// strategy of the game weighs edges, by the next cheapest loop-free ones,
+// those through the preferred exits first.
+func (o *Optimizer) CandidateRoutes(entry string, game string, client string, k int) ([]Route, error) {
+	relays, backend, err := o.OptimizedRoute(entry, game, client)
+	if err != nil {
+		return nil, err
+	}
+	routes := []Route{{Relays: relays, Backend: backend}}
+	conf, _ := o.game(game)
+	ctx := RouteContext{Entry: entry, Game: conf, Client: client}
+	contexts := []RouteContext{ctx}
+	if len(conf.PreferExits) > 0 {
+		preferred := ctx
+		preferred.Exits = conf.PreferExits
+		contexts = []RouteContext{preferred, ctx}
+	}
+	for _, ctx := range contexts {
+		cost := o.strategyCost(ctx)
+		if cost == nil {
+			return routes, nil
+		}
+		paths, _ := o.gr.KShortestPaths(entry, game, k, cost)
+		for _, path := range paths {
+			if len(routes) >= k {
+				return routes, nil
+			}
+			candidate, candidateBackend := splitBackend(path)
+			if slices.ContainsFunc(routes, func(route Route) bool {
+				return route.Backend == candidateBackend && slices.Equal(route.Relays, candidate)
+			}) {
+				continue
+			}
+			routes = append(routes, Route{Relays: candidate, Backend: candidateBackend})
+		}
+	}
+	return routes, nil
+}
+
+// RedundantRoutes returns up to n routes from entry to the exit node of the
+// game that share no relay node, best first, and the backend to connect to.
+// Strategies that do not weigh edges get a single route.
+func (o *Optimizer) RedundantRoutes(entry string, game string, client string, n int) ([][]string, string, error) {
+	routes, backend, err := o.OptimizedRoute(entry, game, client)
+	if err != nil {
+		return nil, "", err
+	}
+	conf, _ := o.game(game)
+	cost := o.strategyCost(RouteContext{Entry: entry, Game: conf, Client: client})
+	if n <= 1 || len(routes) == 0 || routes[len(routes)-1] == entry || cost == nil {
+		return [][]string{routes}, backend, nil
+	}
+	exitNode := routes[len(routes)-1]
+	paths := o.gr.DisjointPaths(entry, exitNode, n, cost)
+	if len(paths) == 0 {
+		return [][]string{routes}, backend, nil
+	}
+	redundant := make([][]string, len(paths))
+	for i, path := range paths {
+		redundant[i] = append(path, exitNode)
+	}
+	return redundant, backend, nil
 }
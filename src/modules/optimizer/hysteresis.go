@@ -0,0 +1,99 @@
+package optimizer
+
+import (
+	"math"
+	"slices"
+	"time"
+)
+
+const (
+	defaultSwitchPercent = 10
+	defaultSwitchHold    = 30 * time.Second
+)
+
+// routeState is the route a game is currently sent over from an entry node,
+// and the route that has been beating it, if any.
+type routeState struct {
+	path       []string
+	challenger []string
+	since      time.Time
+	// pinned routes are left as soon as they are unhealthy
+	pinned bool
+}
+
+// stable damps route flapping. It returns the current route from entry to
+// the game, unless candidate has been better by the configured margin for
+// long enough, or the current route is gone.
+func (o *Optimizer) stable(entry string, game string, candidate []string, cost float64) []string {
+	key := entry + "/" + game
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	state, ok := o.routes[key]
+	if candidate == nil {
+		delete(o.routes, key)
+		return nil
+	}
+	if !ok {
+		o.routes[key] = &routeState{path: candidate}
+		return candidate
+	}
+	if slices.Equal(state.path, candidate) {
+		state.challenger = nil
+		state.pinned = false
+		return state.path
+	}
+	if state.pinned {
+		log.Infof("Pinned route of %s is unhealthy, switching from %v to %v (cost %.3f)", game, state.path, candidate, cost)
+		o.routes[key] = &routeState{path: candidate}
+		return candidate
+	}
+
+	conf, _ := o.game(game)
+	full := append(append([]string{entry}, state.path...), game)
+	current := o.gr.PathCost(full, o.cost(RouteContext{Entry: entry, Game: conf}))
+	if math.IsInf(current, 1) {
+		log.Infof("Route of %s is gone, switching from %v to %v (cost %.3f)", game, state.path, candidate, cost)
+		o.routes[key] = &routeState{path: candidate}
+		return candidate
+	}
+	if !o.better(current, cost) {
+		state.challenger = nil
+		return state.path
+	}
+	if !slices.Equal(state.challenger, candidate) {
+		state.challenger = candidate
+		state.since = time.Now()
+	}
+	if time.Since(state.since) < o.switchHold() {
+		return state.path
+	}
+	log.Infof("Route of %s switches from %v (cost %.3f) to %v (cost %.3f)", game, state.path, current, candidate, cost)
+	o.routes[key] = &routeState{path: candidate}
+	return candidate
+}
+
+// pin makes path the current route from entry to the game at once.
+func (o *Optimizer) pin(entry string, game string, path []string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.routes[entry+"/"+game] = &routeState{path: path, pinned: true}
+}
+
+// better tells if cost beats current by the margins of the system config.
+func (o *Optimizer) better(current float64, cost float64) bool {
+	system := o.n.Config.System
+	percent := system.RouteSwitchPercent
+	if percent == 0 {
+		percent = defaultSwitchPercent
+	}
+	return current-cost >= system.RouteSwitchMargin && current-cost >= current*percent/100
+}
+
+func (o *Optimizer) switchHold() time.Duration {
+	hold := o.n.Config.System.RouteSwitchHold
+	if hold == 0 {
+		return defaultSwitchHold
+	}
+	return time.Duration(hold) * time.Second
+}
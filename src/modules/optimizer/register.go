@@ -4,21 +4,46 @@ import (
 	"github.com/GlazeLab/PureGamer/src/model"
 	logging "github.com/ipfs/go-log/v2"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"sync"
+	"time"
 )
 
 var log = logging.Logger("optimizer")
 
-const topicName = "/PureGamer/latencies"
+const (
+	topicName         = "/PureGamer/latencies"
+	speedTestInterval = time.Minute
+	// defaultExpiryRounds is how many speed test rounds a report is trusted
+	// for when the system config does not say.
+	defaultExpiryRounds = 3
+	// A reported link may be reverseRatio times faster, plus reverseSlack
+	// milliseconds, than the way back before it is distrusted.
+	reverseRatio = 2
+	reverseSlack = 1
+)
 
 type Optimizer struct {
 	gr  *model.Graph
 	sub *pubsub.Subscription
 	top *pubsub.Topic
 	n   *model.Node
+
+	lock sync.Mutex
+	// seen is when each node last published a report.
+	seen map[string]time.Time
+	// routes holds the current route of each entry node and game.
+	routes map[string]*routeState
+	// seq numbers the reports of this node.
+	seq uint64
+	// clocks estimates the clock offsets of the peers for one-way delays.
+	clocks *clocks
+	// measured holds the one-way delays of links as measured by the node
+	// they lead to, to check the claims of the node they leave.
+	measured map[[2]string]model.Latency
 }
 
 func NewOptimizer(node *model.Node) (*Optimizer, error) {
-	err := node.PubSub.RegisterTopicValidator(topicName, validator)
+	err := node.PubSub.RegisterTopicValidator(topicName, newValidator().validate)
 	if err != nil {
 		return nil, err
 	}
@@ -39,10 +64,27 @@ func NewOptimizer(node *model.Node) (*Optimizer, error) {
 	graph := model.NewGraph()
 
 	optimizer := Optimizer{
-		gr:  graph,
-		sub: subscription,
-		top: topic,
-		n:   node,
+		gr:       graph,
+		sub:      subscription,
+		top:      topic,
+		n:        node,
+		seen:     make(map[string]time.Time),
+		routes:   make(map[string]*routeState),
+		clocks:   newClocks(),
+		measured: make(map[[2]string]model.Latency),
+		// starting from the clock keeps the numbers growing across restarts
+		seq: uint64(time.Now().UnixNano()),
+	}
+	// cached routes follow the cost functions of the games
+	node.FlushConfigCallbacks = append(node.FlushConfigCallbacks, func(model.Config) error {
+		graph.FlushCache()
+		return nil
+	})
+	if node.Store != nil {
+		err = optimizer.loadSnapshot(node.CTX)
+		if err != nil {
+			log.Warn(err)
+		}
 	}
 	return &optimizer, nil
 }
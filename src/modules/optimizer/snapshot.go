@@ -0,0 +1,95 @@
+package optimizer
+
+import (
+	"context"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/ipfs/go-datastore"
+	"github.com/vmihailenco/msgpack/v5"
+	"time"
+)
+
+// snapshotMaxAge is how old a graph snapshot may be and still be loaded.
+const snapshotMaxAge = time.Hour
+
+var snapshotKey = datastore.NewKey("/optimizer/graph")
+
+// saveSnapshot writes the graph to the store of the node.
+func (o *Optimizer) saveSnapshot(ctx context.Context) error {
+	data, err := msgpack.Marshal(o.gr.Snapshot())
+	if err != nil {
+		return err
+	}
+	return o.n.Store.Put(ctx, snapshotKey, data)
+}
+
+// loadSnapshot warms the graph up from the last snapshot in the store, so
+// that routes are known before the first reports arrive. Loaded edges count
+// as older than they are, and their metrics are inflated by their age, so
+// that fresh reports win and they expire unless reported again.
+func (o *Optimizer) loadSnapshot(ctx context.Context) error {
+	data, err := o.n.Store.Get(ctx, snapshotKey)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var snapshot model.GraphSnapshot
+	err = msgpack.Unmarshal(data, &snapshot)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Sub(snapshot.Taken) > snapshotMaxAge {
+		log.Infof("Graph snapshot from %s is too old, ignoring it", snapshot.Taken)
+		return nil
+	}
+	// loaded edges get a single speed test round to be reported again
+	updated := now.Add(speedTestInterval - o.expiry())
+	links := make([]model.Link, 0, len(snapshot.Links))
+	for _, link := range snapshot.Links {
+		age := now.Sub(link.Updated)
+		if age > snapshotMaxAge {
+			continue
+		}
+		discount := 1 + float64(age)/float64(snapshotMaxAge)
+		link.Weight *= discount
+		link.Latency.Mean *= discount
+		link.Latency.Jitter *= discount
+		if link.Updated.After(updated) {
+			link.Updated = updated
+		}
+		links = append(links, link)
+	}
+	o.gr.Restore(links, snapshot.Load)
+	log.Infof("Loaded %d edges from the graph snapshot of %s", len(links), snapshot.Taken)
+	return nil
+}
+
+// snapshot saves the graph every speed test round until ctx is done. Close
+// saves it once more.
+func (o *Optimizer) snapshot(ctx context.Context) {
+	ticker := time.NewTicker(speedTestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := o.saveSnapshot(ctx)
+			if err != nil {
+				log.Error(err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close saves the graph a last time when the node stops, so that it routes
+// with it right away when it starts again.
+func (o *Optimizer) Close() error {
+	if o.n.Store == nil {
+		return nil
+	}
+	return o.saveSnapshot(context.Background())
+}
@@ -8,11 +8,16 @@ import (
 	"github.com/libp2p/go-libp2p/core/peer"
 	"math/rand"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func speedTestPeers(ctx context.Context, node *model.Node, latencies model.Latencies) {
+// speedTestPeers runs test on all connected peers at once, and connects to
+// more peers when none of them answers.
+func speedTestPeers(node *model.Node, test func(peerId peer.ID) error) {
 	connectedPeers := node.Host.Network().Peers()
 	var wg sync.WaitGroup
+	var answered atomic.Int64
 	for _, peerId := range connectedPeers {
 		if _, ok := node.BootstrapNodesCheck[peerId]; ok {
 			continue
@@ -20,16 +25,16 @@ func speedTestPeers(ctx context.Context, node *model.Node, latencies model.Laten
 		wg.Add(1)
 		go func(peerId peer.ID) {
 			defer wg.Done()
-			ping, err := pinging.Ping(ctx, node.Host, peerId)
+			err := test(peerId)
 			if err != nil {
 				log.Warn(err)
 				return
 			}
-			latencies[peerId.String()] = float64(ping.Milliseconds())
+			answered.Add(1)
 		}(peerId)
 	}
 	wg.Wait()
-	if len(latencies) == 0 {
+	if answered.Load() == 0 {
 		log.Warn("No connected peers")
 		// need to connect more peers
 		peers := node.Host.Peerstore().Peers()
@@ -45,32 +50,34 @@ func speedTestPeers(ctx context.Context, node *model.Node, latencies model.Laten
 
 func speedTestGames(ctx context.Context, node *model.Node, latencies model.Latencies) {
 	var wg sync.WaitGroup
+	var lock sync.Mutex
 	for _, game := range node.Config.Games {
 		if utils.IsNotAllowed(node.Host.ID().String(), game.ExitNode) {
 			continue
 		}
-		wg.Add(1)
-		go func(game model.Game) {
-			defer wg.Done()
-			switch game.SpeedTestProtocol {
-			case "ICMP":
-				ping, err := pinging.PingICMP(game.Host, game.Port)
-				if err != nil {
-					log.Warn(err)
+		for _, backend := range game.Servers() {
+			wg.Add(1)
+			go func(game model.Game, backend model.Backend) {
+				defer wg.Done()
+				var ping model.Latency
+				var err error
+				switch game.SpeedTestProtocol {
+				case "ICMP":
+					ping, err = pinging.PingICMP(backend.Host, backend.Port)
+				case "TCP":
+					ping, err = pinging.PingTCP(backend.Host, backend.Port)
+				default:
 					return
 				}
-				latencies[game.ID] = float64(ping.Milliseconds())
-				break
-			case "TCP":
-				ping, err := pinging.PingTCP(game.Host, game.Port)
 				if err != nil {
 					log.Warn(err)
 					return
 				}
-				latencies[game.ID] = float64(ping.Milliseconds())
-				break
-			}
-		}(game)
+				lock.Lock()
+				latencies[model.BackendVertex(game.ID, backend.Address())] = ping
+				lock.Unlock()
+			}(game, backend)
+		}
 	}
 	wg.Wait()
 }
@@ -78,7 +85,49 @@ func speedTestGames(ctx context.Context, node *model.Node, latencies model.Laten
 // SpeedTest ping all nodes and measure the latency
 func SpeedTest(ctx context.Context, node *model.Node) model.Latencies {
 	latencies := make(model.Latencies)
-	speedTestPeers(ctx, node, latencies)
+	var lock sync.Mutex
+	speedTestPeers(node, func(peerId peer.ID) error {
+		ping, err := pinging.Ping(ctx, node.Host, peerId)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		latencies[peerId.String()] = ping
+		lock.Unlock()
+		return nil
+	})
 	speedTestGames(ctx, node, latencies)
 	return latencies
 }
+
+// speedTestOneWay measures the delay towards each peer, and back from it
+// into reverse. Backends can only be measured by round trip, and count as
+// half of it.
+func (o *Optimizer) speedTestOneWay(ctx context.Context, synced bool) (model.Latencies, model.Latencies) {
+	latencies := make(model.Latencies)
+	reverse := make(model.Latencies)
+	var lock sync.Mutex
+	speedTestPeers(o.n, func(peerId peer.ID) error {
+		samples, lost, err := pinging.PingTimed(ctx, o.n.Host, peerId)
+		if err != nil {
+			return err
+		}
+		var offset time.Duration
+		if !synced {
+			offset = o.clocks.update(peerId.String(), pinging.EstimateOffset(samples))
+		}
+		forward, back := pinging.OneWay(samples, lost, offset)
+		lock.Lock()
+		latencies[peerId.String()] = forward
+		reverse[peerId.String()] = back
+		lock.Unlock()
+		return nil
+	})
+
+	backends := make(model.Latencies)
+	speedTestGames(ctx, o.n, backends)
+	for vertex, latency := range backends {
+		latencies[vertex] = latency.Half()
+	}
+	return latencies, reverse
+}
@@ -0,0 +1,227 @@
+package optimizer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// RouteContext is what a routing strategy knows about the connection it
+// routes.
+type RouteContext struct {
+	Entry string
+	Game  model.Game
+	// Client is the address of the player, if known.
+	Client string
+	// Current is the route the entry node sends the game over now, if any.
+	Current []string
+	// Exits, when set, are the only nodes the route may exit through.
+	Exits []string
+}
+
+// RoutingStrategy chooses the path from the entry node to the vertex of the
+// game. Like model.Graph.ShortestPath, the path leaves out both ends, and
+// ends with the exit node and the backend vertex. A nil path means the game
+// cannot be reached. Strategies keep to the nodes and exits the context
+// allows by weighing edges with constrain.
+type RoutingStrategy interface {
+	Route(g *model.Graph, ctx RouteContext) ([]string, float64)
+}
+
+// CostStrategy is a strategy that weighs edges with a cost function, which
+// lets the optimizer rank fallback routes and migrate sessions with it.
+type CostStrategy interface {
+	RoutingStrategy
+	Cost(ctx RouteContext) model.Cost
+}
+
+const (
+	// DefaultStrategy is used by games that do not name one.
+	DefaultStrategy = "weighted"
+	// PinnedStrategy only routes over the pinned routes of the game.
+	PinnedStrategy = "admin-pinned"
+	// pinnedMaxLoss is the loss above which a link of a pinned route is down.
+	pinnedMaxLoss = 0.2
+)
+
+// ErrUnreachable is returned for games that cannot be reached and must not
+// be exited at the entry node instead.
+var ErrUnreachable = errors.New("game cannot be reached")
+
+var (
+	strategiesLock sync.RWMutex
+	strategies     = map[string]RoutingStrategy{
+		DefaultStrategy:    costStrategy(func(game model.Game) model.Cost { return game.Cost.Cost() }),
+		"shortest-latency": costStrategy(func(model.Game) model.Cost { return latencyCost }),
+		"lowest-loss":      costStrategy(func(model.Game) model.Cost { return lossCost }),
+		"fewest-hops":      costStrategy(func(model.Game) model.Cost { return hopCost }),
+		"direct-only":      directStrategy{},
+		PinnedStrategy:     pinnedStrategy{},
+	}
+)
+
+// RegisterStrategy makes a strategy available to games under name.
+func RegisterStrategy(name string, strategy RoutingStrategy) error {
+	strategiesLock.Lock()
+	defer strategiesLock.Unlock()
+	if _, ok := strategies[name]; ok {
+		return fmt.Errorf("routing strategy %s is already registered", name)
+	}
+	strategies[name] = strategy
+	return nil
+}
+
+// strategyOf returns the strategy the game names, or the default one when
+// it names none or an unknown one.
+func strategyOf(game model.Game) RoutingStrategy {
+	name := game.Strategy
+	if name == "" {
+		name = DefaultStrategy
+	}
+	strategiesLock.RLock()
+	defer strategiesLock.RUnlock()
+	strategy, ok := strategies[name]
+	if !ok {
+		log.Warnf("Game %s uses unknown routing strategy %s, using %s", game.ID, name, DefaultStrategy)
+		return strategies[DefaultStrategy]
+	}
+	return strategy
+}
+
+// costStrategy takes the cheapest path under the cost function it returns
+// for the game.
+type costStrategy func(game model.Game) model.Cost
+
+func (s costStrategy) Route(g *model.Graph, ctx RouteContext) ([]string, float64) {
+	return g.ShortestPathCached(ctx.Entry, ctx.Game.ID, costKey(ctx), s.Cost(ctx))
+}
+
+// costKey names the cost function of a cost strategy in the context, to
+// share shortest-path trees between the connections of a game. The cost of
+// a game only changes with the config, which flushes the trees.
+func costKey(ctx RouteContext) string {
+	return ctx.Game.ID + "/" + strings.Join(ctx.Exits, ",")
+}
+
+func (s costStrategy) Cost(ctx RouteContext) model.Cost {
+	return constrain(ctx, s(ctx.Game))
+}
+
+func latencyCost(from string, edge model.Edge, load float64) float64 {
+	return edge.Latency.Mean
+}
+
+// lossCost adds up the logarithms of the delivery ratios, so that the path
+// losing the fewest packets end to end is the cheapest. Latency breaks ties.
+func lossCost(from string, edge model.Edge, load float64) float64 {
+	return -math.Log1p(-edge.Latency.Loss) + edge.Latency.Mean*1e-6
+}
+
+// hopCost counts the edges of a path. Latency breaks ties.
+func hopCost(from string, edge model.Edge, load float64) float64 {
+	return 1 + edge.Latency.Mean*1e-6
+}
+
+// constrain leaves out of cost the edges into the nodes the game avoids, and
+// the exits the context does not allow.
+func constrain(ctx RouteContext, cost model.Cost) model.Cost {
+	avoid := ctx.Game.AvoidNodes
+	exits := ctx.Exits
+	if len(avoid) == 0 && len(exits) == 0 {
+		return cost
+	}
+	return func(from string, edge model.Edge, load float64) float64 {
+		if slices.Contains(avoid, edge.To) {
+			return math.Inf(1)
+		}
+		if _, _, ok := model.ParseBackendVertex(edge.To); ok && len(exits) > 0 && !slices.Contains(exits, from) {
+			return math.Inf(1)
+		}
+		return cost(from, edge, load)
+	}
+}
+
+// directStrategy goes from the entry node straight to an exit node, without
+// relays in between.
+type directStrategy struct{}
+
+func (directStrategy) Route(g *model.Graph, ctx RouteContext) ([]string, float64) {
+	cost := constrain(ctx, ctx.Game.Cost.Cost())
+	var best []string
+	bestCost := math.Inf(1)
+	for _, exitNode := range append([]string{ctx.Entry}, g.IterateEdges(ctx.Entry)...) {
+		relays := []string{exitNode}
+		if exitNode == ctx.Entry {
+			relays = nil
+		}
+		path, pathCost := exitVia(g, ctx, relays, cost)
+		if path != nil && pathCost < bestCost {
+			best, bestCost = path, pathCost
+		}
+	}
+	return best, bestCost
+}
+
+// pinnedStrategy never routes automatically: the game cannot be reached
+// while none of its pinned routes is healthy.
+type pinnedStrategy struct{}
+
+func (pinnedStrategy) Route(g *model.Graph, ctx RouteContext) ([]string, float64) {
+	return pinned(g, ctx)
+}
+
+// pinned returns the first route pinned for the game that is healthy: all
+// its links are reported, and none loses more than pinnedMaxLoss of its
+// packets. Nodes the game avoids do not apply, the admin chose the route.
+func pinned(g *model.Graph, ctx RouteContext) ([]string, float64) {
+	cost := ctx.Game.Cost.Cost()
+	for _, route := range ctx.Game.PinnedRoutes {
+		if !healthy(g, append([]string{ctx.Entry}, route...)) {
+			continue
+		}
+		path, pathCost := exitVia(g, ctx, route, cost)
+		if path != nil {
+			return path, pathCost
+		}
+	}
+	return nil, math.Inf(1)
+}
+
+func healthy(g *model.Graph, path []string) bool {
+	for i := 0; i+1 < len(path); i++ {
+		edge, ok := g.FindEdge(path[i], path[i+1])
+		if !ok || edge.Latency.Loss > pinnedMaxLoss {
+			return false
+		}
+	}
+	return true
+}
+
+// exitVia completes relays, which end with the exit node, with the cheapest
+// backend of the game the exit node reports. It returns nil when a link is
+// missing.
+func exitVia(g *model.Graph, ctx RouteContext, relays []string, cost model.Cost) ([]string, float64) {
+	exitNode := ctx.Entry
+	if len(relays) > 0 {
+		exitNode = relays[len(relays)-1]
+	}
+	var best []string
+	bestCost := math.Inf(1)
+	for _, vertex := range g.IterateEdges(exitNode) {
+		gameId, _, ok := model.ParseBackendVertex(vertex)
+		if !ok || gameId != ctx.Game.ID {
+			continue
+		}
+		path := append(slices.Clone(relays), vertex)
+		full := append(append([]string{ctx.Entry}, path...), ctx.Game.ID)
+		pathCost := g.PathCost(full, cost)
+		if pathCost < bestCost {
+			best, bestCost = path, pathCost
+		}
+	}
+	return best, bestCost
+}
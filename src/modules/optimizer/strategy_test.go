@@ -0,0 +1,86 @@
+package optimizer
+
+import (
+	"errors"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestOptimizer routes the games of config over g, without a network.
+func newTestOptimizer(g *model.Graph, config model.Config) *Optimizer {
+	return &Optimizer{
+		gr:       g,
+		n:        &model.Node{Config: &config},
+		seen:     make(map[string]time.Time),
+		routes:   make(map[string]*routeState),
+		clocks:   newClocks(),
+		measured: make(map[[2]string]model.Latency),
+	}
+}
+
+// exitTo links node to the backend of game as an exit node does.
+func exitTo(g *model.Graph, node string, game string, latency float64) {
+	vertex := model.BackendVertex(game, "10.0.0.1:25565")
+	g.AddLink(node, vertex, model.Latency{Mean: latency})
+	g.AddEdge(vertex, game, 0)
+}
+
+func TestPinnedStrategyUnreachable(t *testing.T) {
+	g := model.NewGraph()
+	g.AddLink("entry", "relay", model.Latency{Mean: 10})
+	g.AddLink("relay", "exit", model.Latency{Mean: 10})
+	exitTo(g, "exit", "game", 10)
+	// the entry node could exit the game itself, and through another node
+	exitTo(g, "entry", "game", 1)
+	g.AddLink("entry", "other", model.Latency{Mean: 1})
+	exitTo(g, "other", "game", 1)
+
+	o := newTestOptimizer(g, model.Config{Games: []model.Game{{
+		ID:           "game",
+		Strategy:     PinnedStrategy,
+		PinnedRoutes: [][]string{{"relay", "exit"}},
+	}}})
+
+	routes, err := o.CandidateRoutes("entry", "game", "", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 1 || !slices.Equal(routes[0].Relays, []string{"relay", "exit"}) {
+		t.Fatalf("candidate routes %v, want the pinned one only", routes)
+	}
+
+	g.RemoveEdge("relay", "exit")
+	relays, backend, err := o.OptimizedRoute("entry", "game", "")
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("optimized route %v to %q, error %v, want ErrUnreachable", relays, backend, err)
+	}
+	routes, err = o.CandidateRoutes("entry", "game", "", 3)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("candidate routes %v, error %v, want ErrUnreachable", routes, err)
+	}
+	redundant, _, err := o.RedundantRoutes("entry", "game", "", 2)
+	if !errors.Is(err, ErrUnreachable) {
+		t.Errorf("redundant routes %v, error %v, want ErrUnreachable", redundant, err)
+	}
+}
+
+func TestWeightedStrategyExitsLocally(t *testing.T) {
+	g := model.NewGraph()
+	exitTo(g, "entry", "game", 1)
+	g.AddLink("entry", "relay", model.Latency{Mean: 10})
+	exitTo(g, "relay", "game", 10)
+
+	o := newTestOptimizer(g, model.Config{Games: []model.Game{{
+		ID:           "game",
+		PinnedRoutes: [][]string{{"missing"}},
+	}}})
+	relays, backend, err := o.OptimizedRoute("entry", "game", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(relays) != 0 || backend == "" {
+		t.Errorf("optimized route %v to %q, want to exit at the entry node", relays, backend)
+	}
+}
@@ -2,19 +2,38 @@ package optimizer
 
 import (
 	"context"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/modules/relaying"
 	"github.com/vmihailenco/msgpack/v5"
 	"time"
 )
 
 func (o *Optimizer) RunSpeedTest(ctx context.Context) {
 	log.Info("Start speed test")
-	ticker := time.NewTicker(1 * time.Minute)
+	ticker := time.NewTicker(speedTestInterval)
 	for {
 		select {
 		case <-ticker.C:
-			latencies := SpeedTest(ctx, o.n)
-			log.Infof("Latencies: %v", latencies)
-			latenciesBytes, err := msgpack.Marshal(latencies)
+			var latencies, reverse model.Latencies
+			switch mode := o.n.Config.System.OneWayDelay; mode {
+			case "":
+				latencies = SpeedTest(ctx, o.n)
+			case "estimated", "synced":
+				latencies, reverse = o.speedTestOneWay(ctx, mode == "synced")
+			default:
+				log.Errorf("Unknown one-way delay mode %s, measuring round trips", mode)
+				latencies = SpeedTest(ctx, o.n)
+			}
+			o.seq++
+			report := model.Report{
+				Seq:       o.seq,
+				Timestamp: time.Now().UnixMilli(),
+				Latencies: latencies,
+				Reverse:   reverse,
+				Load:      relaying.Streams(),
+			}
+			log.Infof("Latencies: %v, load: %d", report.Latencies, report.Load)
+			latenciesBytes, err := msgpack.Marshal(report)
 			if err != nil {
 				log.Error(err)
 				continue
@@ -30,3 +49,77 @@ func (o *Optimizer) RunSpeedTest(ctx context.Context) {
 		}
 	}
 }
+
+// game returns the config of the game.
+func (o *Optimizer) game(gameId string) (model.Game, bool) {
+	for _, game := range o.n.Config.Games {
+		if game.ID == gameId {
+			return game, true
+		}
+	}
+	return model.Game{ID: gameId}, false
+}
+
+// cost returns the cost function routes in ctx are compared with: the one of
+// the strategy of the game, or its configured weights kept to the nodes ctx
+// allows.
+func (o *Optimizer) cost(ctx RouteContext) model.Cost {
+	cost := o.strategyCost(ctx)
+	if cost == nil {
+		return constrain(ctx, ctx.Game.Cost.Cost())
+	}
+	return cost
+}
+
+// strategyCost returns the cost function of the strategy of the game in ctx,
+// or nil when the strategy does not weigh edges.
+func (o *Optimizer) strategyCost(ctx RouteContext) model.Cost {
+	strategy, ok := strategyOf(ctx.Game).(CostStrategy)
+	if !ok {
+		return nil
+	}
+	return strategy.Cost(ctx)
+}
+
+// expiry returns how long reports are trusted for.
+func (o *Optimizer) expiry() time.Duration {
+	rounds := o.n.Config.System.EdgeExpiryRounds
+	if rounds == 0 {
+		rounds = defaultExpiryRounds
+	}
+	return time.Duration(rounds) * speedTestInterval
+}
+
+// expire drops the edges that were not reported for too long, and the nodes
+// that stopped publishing reports, until ctx is done.
+func (o *Optimizer) expire(ctx context.Context) {
+	ticker := time.NewTicker(speedTestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			deadline := time.Now().Add(-o.expiry())
+			o.lock.Lock()
+			for node, seen := range o.seen {
+				if seen.Before(deadline) {
+					log.Warnf("Node %s stopped reporting, dropping it", node)
+					o.gr.RemoveNode(node)
+					delete(o.seen, node)
+					o.clocks.forget(node)
+					for link := range o.measured {
+						if link[0] == node || link[1] == node {
+							delete(o.measured, link)
+						}
+					}
+				}
+			}
+			o.lock.Unlock()
+			removed := o.gr.ExpireEdges(deadline)
+			if removed > 0 {
+				log.Infof("Expired %d stale edges", removed)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -6,13 +6,78 @@ import (
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/vmihailenco/msgpack/v5"
+	"sync"
+	"time"
 )
 
-func validator(ctx context.Context, pid peer.ID, msg *pubsub.Message) bool {
-	var cmd model.Latencies
+const (
+	// reportMaxAge is how old a report may be when it arrives.
+	reportMaxAge = 2 * speedTestInterval
+	// clockSkew is how far in the future a report may be dated.
+	clockSkew = 30 * time.Second
+	// maxReporters bounds how many nodes the sequence numbers are kept for.
+	maxReporters = 4096
+)
+
+// lastReport is the newest report accepted from a node.
+type lastReport struct {
+	seq    uint64
+	issued time.Time
+}
+
+// validator rejects reports that are malformed, unsigned, stale, or not
+// newer than the last report of their node.
+type validator struct {
+	lock sync.Mutex
+	last map[peer.ID]lastReport
+}
+
+func newValidator() *validator {
+	return &validator{last: make(map[peer.ID]lastReport)}
+}
+
+// pruneLocked forgets the nodes whose last report is too old to be accepted
+// again anyway.
+func (v *validator) pruneLocked(now time.Time) {
+	for pid, last := range v.last {
+		if last.issued.Before(now.Add(-reportMaxAge)) {
+			delete(v.last, pid)
+		}
+	}
+}
+
+func (v *validator) validate(ctx context.Context, pid peer.ID, msg *pubsub.Message) bool {
+	if msg.Signature == nil {
+		return false
+	}
+	var cmd model.Report
 	err := msgpack.Unmarshal(msg.GetData(), &cmd)
 	if err != nil {
 		return false
 	}
+
+	now := time.Now()
+	issued := time.UnixMilli(cmd.Timestamp)
+	if issued.Before(now.Add(-reportMaxAge)) || issued.After(now.Add(clockSkew)) {
+		log.Warnf("Rejected report of %s dated %s", msg.GetFrom(), issued)
+		return false
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	from := msg.GetFrom()
+	last, ok := v.last[from]
+	if cmd.Seq <= last.seq {
+		log.Warnf("Rejected report %d of %s, already had %d", cmd.Seq, from, last.seq)
+		return false
+	}
+	if !ok && len(v.last) >= maxReporters {
+		v.pruneLocked(now)
+		if len(v.last) >= maxReporters {
+			log.Warnf("Rejected report of %s, tracking %d nodes already", from, len(v.last))
+			return false
+		}
+	}
+	v.last[from] = lastReport{seq: cmd.Seq, issued: issued}
 	return true
 }
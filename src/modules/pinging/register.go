@@ -9,13 +9,23 @@ import (
 var log = logging.Logger("ping")
 
 const (
-	protocol    = "/PureGamer/ping"
-	PingSize    = 32
-	pingTimeout = time.Second * 60
-	ServiceName = "PureGamer.ping"
+	protocol = "/PureGamer/ping"
+	// timedProtocol answers pings with the times they were received and
+	// replied to, to tell the delays each way.
+	timedProtocol = "/PureGamer/ping/timed"
+	PingSize      = 32
+	pingTimeout   = time.Second * 60
+	ServiceName   = "PureGamer.ping"
+	// Samples is how many probes one speed test of a link sends.
+	Samples        = 5
+	sampleInterval = 100 * time.Millisecond
+	sampleTimeout  = 2 * time.Second
+	// timedSize is a ping followed by two timestamps.
+	timedSize = PingSize + 16
 )
 
 func Register(node *model.Node) error {
 	node.Host.SetStreamHandler(protocol, pingHandler)
+	node.Host.SetStreamHandler(timedProtocol, timedHandler)
 	return nil
 }
@@ -0,0 +1,155 @@
+package pinging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/GlazeLab/PureGamer/src/model"
+	pool "github.com/libp2p/go-buffer-pool"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"io"
+	"slices"
+	"time"
+)
+
+// TimedSample is one timestamped probe. Sent and Back are read from the
+// clock of the prober, Received and Replied from the clock of the peer.
+type TimedSample struct {
+	Sent     time.Time
+	Received time.Time
+	Replied  time.Time
+	Back     time.Time
+}
+
+// RTT is the round trip of the probe, without the time the peer held it.
+func (s TimedSample) RTT() time.Duration {
+	return s.Back.Sub(s.Sent) - s.Replied.Sub(s.Received)
+}
+
+// Offset is how far the clock of the peer is ahead, if the probe took as
+// long each way.
+func (s TimedSample) Offset() time.Duration {
+	return (s.Received.Sub(s.Sent) + s.Replied.Sub(s.Back)) / 2
+}
+
+func timedHandler(s network.Stream) {
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		log.Debugf("error attaching stream to ping service: %s", err)
+		s.Reset()
+		return
+	}
+	defer s.Close()
+
+	buf := pool.Get(timedSize)
+	defer pool.Put(buf)
+
+	for {
+		s.SetReadDeadline(time.Now().Add(pingTimeout))
+		_, err := io.ReadFull(s, buf[:PingSize])
+		if err != nil {
+			log.Debug(err)
+			return
+		}
+		binary.BigEndian.PutUint64(buf[PingSize:], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(buf[PingSize+8:], uint64(time.Now().UnixNano()))
+		_, err = s.Write(buf)
+		if err != nil {
+			log.Debug(err)
+			return
+		}
+	}
+}
+
+// PingTimed sends Samples timestamped pings to p. It returns the samples
+// that got an answer, and how many were lost. The timestamps only tell the
+// two ways apart when the clocks of both nodes are in sync.
+func PingTimed(ctx context.Context, h host.Host, p peer.ID) ([]TimedSample, int, error) {
+	s, err := h.NewStream(network.WithUseTransient(ctx, "ping"), p, timedProtocol)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = s.Scope().SetService(ServiceName); err != nil {
+		s.Reset()
+		return nil, 0, err
+	}
+
+	request := make([]byte, PingSize)
+	response := make([]byte, timedSize)
+	samples := make([]TimedSample, 0, Samples)
+	lost := 0
+	for i := 0; i < Samples; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(sampleInterval):
+			case <-ctx.Done():
+				s.Reset()
+				return nil, 0, ctx.Err()
+			}
+		}
+		if _, err = rand.Read(request); err != nil {
+			s.Reset()
+			return nil, 0, err
+		}
+		s.SetDeadline(time.Now().Add(sampleTimeout))
+		sent := time.Now()
+		_, err = s.Write(request)
+		if err == nil {
+			_, err = io.ReadFull(s, response)
+		}
+		back := time.Now()
+		if err != nil {
+			// the stream is out of step now, the rest is lost too
+			log.Debugf("error pinging peer %s: %s", p, err)
+			lost += Samples - i
+			break
+		}
+		if !bytes.Equal(request, response[:PingSize]) {
+			s.Reset()
+			return nil, 0, errors.New("ping packet was incorrect")
+		}
+		samples = append(samples, TimedSample{
+			Sent:     sent,
+			Received: time.Unix(0, int64(binary.BigEndian.Uint64(response[PingSize:]))),
+			Replied:  time.Unix(0, int64(binary.BigEndian.Uint64(response[PingSize+8:]))),
+			Back:     back,
+		})
+	}
+	if len(samples) == 0 {
+		s.Reset()
+		if err == nil {
+			err = ErrAllLost
+		}
+		return nil, lost, err
+	}
+	s.Close()
+	return samples, lost, nil
+}
+
+// EstimateOffset estimates how far the clock of the peer is ahead from the
+// sample with the shortest round trip, which waited least in queues. Like
+// NTP, it assumes that sample took as long each way: the asymmetry of a link
+// ends up in the offset, not in the one-way delays.
+func EstimateOffset(samples []TimedSample) time.Duration {
+	best := slices.MinFunc(samples, func(a, b TimedSample) int {
+		return int(a.RTT() - b.RTT())
+	})
+	return best.Offset()
+}
+
+// OneWay summarizes the delays of the samples towards the peer and back,
+// given how far its clock is ahead. Delays the offset makes negative count
+// as zero. With an offset from EstimateOffset, the fastest ways there and
+// back come out equal.
+func OneWay(samples []TimedSample, lost int, offset time.Duration) (model.Latency, model.Latency) {
+	forward := make([]time.Duration, len(samples))
+	reverse := make([]time.Duration, len(samples))
+	for i, sample := range samples {
+		forward[i] = max(sample.Received.Sub(sample.Sent)-offset, 0)
+		reverse[i] = max(sample.Back.Sub(sample.Replied)+offset, 0)
+	}
+	return summarize(forward, lost), summarize(reverse, lost)
+}
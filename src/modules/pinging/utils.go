@@ -6,49 +6,96 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"errors"
-	"fmt"
+	"github.com/GlazeLab/PureGamer/src/model"
 	icmping "github.com/go-ping/ping"
 	pool "github.com/libp2p/go-buffer-pool"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"io"
+	"math"
 	mrand "math/rand"
 	"net"
+	"strconv"
 	"time"
 )
 
-func Ping(ctx context.Context, h host.Host, p peer.ID) (time.Duration, error) {
+// ErrAllLost is returned when none of the samples of a speed test got an answer.
+var ErrAllLost = errors.New("all ping samples were lost")
+
+// Ping sends Samples pings to p and summarizes their round-trip times. A
+// sample that gets no answer within sampleTimeout counts as lost.
+func Ping(ctx context.Context, h host.Host, p peer.ID) (model.Latency, error) {
 	var err error
 	var s network.Stream
-	s, err = h.NewStream(network.WithUseTransient(ctx, "ping"), p, protocol)
+	s, err = openPing(ctx, h, p)
 	if err != nil {
-		return 0, err
-	}
-
-	if err = s.Scope().SetService(ServiceName); err != nil {
-		log.Debugf("error attaching stream to ping service: %s", err)
-		s.Reset()
-		return 0, err
+		return model.Latency{}, err
 	}
 
 	b := make([]byte, 8)
 	if _, err = rand.Read(b); err != nil {
 		log.Errorf("failed to get cryptographic random: %s", err)
 		s.Reset()
-		return 0, err
+		return model.Latency{}, err
 	}
 
 	ra := mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(b))))
 
-	var duration time.Duration
-	duration, err = ping(s, ra)
+	samples := make([]time.Duration, 0, Samples)
+	lost := 0
+	for i := 0; i < Samples; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(sampleInterval):
+			case <-ctx.Done():
+				s.Reset()
+				return model.Latency{}, ctx.Err()
+			}
+		}
+		if s == nil {
+			// a lost sample leaves the stream out of step, start over
+			s, err = openPing(ctx, h, p)
+			if err != nil {
+				lost += Samples - i
+				break
+			}
+		}
+		s.SetDeadline(time.Now().Add(sampleTimeout))
+		var duration time.Duration
+		duration, err = ping(s, ra)
+		if err != nil {
+			log.Debugf("error pinging peer %s: %s", p, err)
+			s.Reset()
+			s = nil
+			lost++
+			continue
+		}
+		samples = append(samples, duration)
+	}
+	if s != nil {
+		s.Close()
+	}
+	if len(samples) == 0 {
+		if err == nil {
+			err = ErrAllLost
+		}
+		return model.Latency{}, err
+	}
+	return summarize(samples, lost), nil
+}
+
+func openPing(ctx context.Context, h host.Host, p peer.ID) (network.Stream, error) {
+	s, err := h.NewStream(network.WithUseTransient(ctx, "ping"), p, protocol)
 	if err != nil {
-		log.Debugf("error pinging peer %s: %s", p, err)
+		return nil, err
+	}
+	if err = s.Scope().SetService(ServiceName); err != nil {
+		log.Debugf("error attaching stream to ping service: %s", err)
 		s.Reset()
-		return 0, err
+		return nil, err
 	}
-	return duration, nil
+	return s, nil
 }
 
 func ping(s network.Stream, randReader io.Reader) (time.Duration, error) {
@@ -85,26 +132,96 @@ func ping(s network.Stream, randReader io.Reader) (time.Duration, error) {
 	return time.Since(before), nil
 }
 
-func PingICMP(host string, port uint64) (time.Duration, error) {
+// summarize computes the statistics of the samples that got an answer.
+func summarize(samples []time.Duration, lost int) model.Latency {
+	var sum float64
+	minimum := math.Inf(1)
+	for _, sample := range samples {
+		ms := model.Milliseconds(sample)
+		sum += ms
+		minimum = math.Min(minimum, ms)
+	}
+	mean := sum / float64(len(samples))
+	var variance float64
+	for _, sample := range samples {
+		diff := model.Milliseconds(sample) - mean
+		variance += diff * diff
+	}
+	variance /= float64(len(samples))
+	return model.Latency{
+		Mean:   math.Round(mean*1000) / 1000,
+		Min:    minimum,
+		Jitter: math.Round(math.Sqrt(variance)*1000) / 1000,
+		Loss:   float64(lost) / float64(len(samples)+lost),
+	}
+}
+
+func PingICMP(host string, port uint64) (model.Latency, error) {
+	return pingICMP(host, Samples)
+}
+
+// ProbeICMP is PingICMP with a single echo, to check that the server is up.
+func ProbeICMP(host string, port uint64) (model.Latency, error) {
+	return pingICMP(host, 1)
+}
+
+func pingICMP(host string, count int) (model.Latency, error) {
 	pinger, err := icmping.NewPinger(host)
 	if err != nil {
-		return 0, err
+		return model.Latency{}, err
 	}
-	pinger.Count = 3
+	pinger.Count = count
+	pinger.Interval = sampleInterval
+	pinger.Timeout = time.Duration(count)*sampleInterval + sampleTimeout
 	err = pinger.Run()
 	if err != nil {
-		return 0, err
+		return model.Latency{}, err
 	}
-	stats := pinger.Statistics().AvgRtt
-	return stats, err
+	stats := pinger.Statistics()
+	if stats.PacketsRecv == 0 {
+		return model.Latency{}, ErrAllLost
+	}
+	return model.Latency{
+		Mean:   model.Milliseconds(stats.AvgRtt),
+		Min:    model.Milliseconds(stats.MinRtt),
+		Jitter: model.Milliseconds(stats.StdDevRtt),
+		Loss:   stats.PacketLoss / 100,
+	}, nil
 }
 
-func PingTCP(host string, port uint64) (time.Duration, error) {
-	start := time.Now()
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", host, port), time.Duration(10)*time.Second)
-	if err != nil {
-		return 0, err
+// PingTCP measures how long TCP handshakes with the server take. A
+// connection that cannot be made within sampleTimeout counts as lost.
+func PingTCP(host string, port uint64) (model.Latency, error) {
+	return pingTCP(host, port, Samples)
+}
+
+// ProbeTCP is PingTCP with a single handshake, to check that the server is
+// up without loading it.
+func ProbeTCP(host string, port uint64) (model.Latency, error) {
+	return pingTCP(host, port, 1)
+}
+
+func pingTCP(host string, port uint64, count int) (model.Latency, error) {
+	address := net.JoinHostPort(host, strconv.FormatUint(port, 10))
+	samples := make([]time.Duration, 0, count)
+	lost := 0
+	var err error
+	for i := 0; i < count; i++ {
+		if i > 0 {
+			time.Sleep(sampleInterval)
+		}
+		start := time.Now()
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", address, sampleTimeout)
+		if err != nil {
+			lost++
+			continue
+		}
+		samples = append(samples, time.Since(start))
+		conn.Close()
+	}
+	if len(samples) == 0 {
+		return model.Latency{}, err
 	}
-	defer conn.Close()
-	return time.Since(start), nil
+	return summarize(samples, lost), nil
 }
@@ -1,57 +1,83 @@
 package relaying
 
 import (
-	"fmt"
 	"github.com/GlazeLab/PureGamer/src/model"
 	"github.com/GlazeLab/PureGamer/src/modules/exit"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/protocol"
 	"io"
-	"strings"
+	"time"
 )
 
+// headerTimeout bounds how long a hop waits for the route header.
+const headerTimeout = 10 * time.Second
+
 func getHandler(node *model.Node, exits *exit.Exit) func(network.Stream) {
 	return func(income network.Stream) {
 		defer income.Close()
 		income.Scope().SetService(ServiceName)
 
-		log.Info("Relaying income stream from peer:", income.Conn().RemotePeer().String())
+		remotePeer := income.Conn().RemotePeer()
+		log.Info("Relaying income stream from peer:", remotePeer.String())
+
+		var header model.RouteHeader
+		income.SetReadDeadline(time.Now().Add(headerTimeout))
+		err := readMessage(income, &header)
+		income.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Error(err)
+			income.Reset()
+			return
+		}
 
-		p := income.Protocol()
-		subMatches := pattern.FindStringSubmatch(string(p))
-		gameID := subMatches[2]
-		nextPeers := strings.Split(subMatches[3], "/next/")
+		ticket, err := checkHeader(node, header, remotePeer)
+		if err != nil {
+			log.Warnf("Rejected route from %s: %s", remotePeer, err)
+			writeStatus(income, model.RouteInvalid, err)
+			return
+		}
+		err = authorize(node, exits, ticket)
+		if err != nil {
+			log.Warnf("Rejected route from %s: %s", remotePeer, err)
+			writeStatus(income, model.RouteUnauthorized, err)
+			return
+		}
+		streams.Add(1)
+		defer streams.Add(-1)
 
-		if len(nextPeers) > 1 {
-			log.Info("Relay to peer:", nextPeers[1])
+		if ticket.Next != "" {
+			log.Info("Relay to peer:", ticket.Next)
 			// forward to the next peer
-			nextPeerId, err := peer.Decode(nextPeers[1])
+			nextPeerId, err := peer.Decode(ticket.Next)
 			if err != nil {
 				log.Error(err)
-				income.Reset()
+				writeStatus(income, model.RouteInvalid, err)
 				return
 			}
 
-			// rebuild the protocol id
-			protocolId := fmt.Sprintf("/PureGamer/relay/%s/game/%s", subMatches[1], gameID)
-			for _, peerId := range nextPeers[2:] {
-				protocolId += fmt.Sprintf("/next/%s", peerId)
+			outcome, err := node.Host.NewStream(node.CTX, nextPeerId, protocolId)
+			if err != nil {
+				log.Error(err)
+				writeStatus(income, model.RouteUnreachable, err)
+				return
 			}
+			defer outcome.Close()
+			outcome.Scope().SetService(ServiceName)
 
-			outcome, err := node.Host.NewStream(node.CTX, nextPeerId, protocol.ID(protocolId))
+			// pass the rest of the route on, the status of the exit node
+			// comes back through the pipe below
+			err = writeMessage(outcome, model.RouteHeader{Tickets: header.Tickets[1:]})
 			if err != nil {
 				log.Error(err)
+				outcome.Reset()
 				income.Reset()
 				return
 			}
-			defer outcome.Close()
-			outcome.Scope().SetService(ServiceName)
 
-			done := make(chan struct{})
+			done := make(chan struct{}, 2)
 
 			go func() {
-				_, err = io.Copy(outcome, income)
+				_, err := io.Copy(outcome, income)
 				if err != nil {
 					log.Error(err)
 				}
@@ -59,7 +85,7 @@ func getHandler(node *model.Node, exits *exit.Exit) func(network.Stream) {
 			}()
 
 			go func() {
-				_, err = io.Copy(income, outcome)
+				_, err := io.Copy(income, outcome)
 				if err != nil {
 					log.Error(err)
 				}
@@ -70,7 +96,19 @@ func getHandler(node *model.Node, exits *exit.Exit) func(network.Stream) {
 		} else {
 			// final destination
 			log.Info("Relay reach final destination")
-			err := exits.Handle(income, gameID, nil)
+			err = writeStatus(income, model.RouteAccepted, nil)
+			if err != nil {
+				log.Error(err)
+				income.Reset()
+				return
+			}
+			err = exits.Handle(income, exit.Target{
+				GameID:  ticket.GameID,
+				Client:  ticket.Client,
+				Backend: ticket.Backend,
+				Entry:   ticket.Entry,
+				Session: ticket.Session,
+			}, nil)
 			if err != nil {
 				log.Error(err)
 				income.Reset()
@@ -4,21 +4,34 @@ import (
 	"github.com/GlazeLab/PureGamer/src/model"
 	"github.com/GlazeLab/PureGamer/src/modules/exit"
 	logging "github.com/ipfs/go-log/v2"
-	"regexp"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"sync/atomic"
+	"time"
 )
 
-var (
-	pattern, _ = regexp.Compile(`^/PureGamer/relay/([a-zA-Z0-9.]+)/game/([123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz]+)((?:/next/[123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz]+)*)$`)
-	log        = logging.Logger("relaying")
-)
+var log = logging.Logger("relaying")
 
 const (
 	ServiceName = "PureGamer.relay"
-	version     = "0.0.1"
+	version     = "0.0.2"
+	protocolId  = protocol.ID("/PureGamer/relay/" + version)
+	// maxHops limits the length of a relay route.
+	maxHops = 16
+	// ticketTTL is how long a route header may be used after it is signed.
+	ticketTTL = 2 * time.Minute
 )
 
-// Register /PureGamer/relay/<version>/game/<gameid>/next/<peerid>/next/<peerid>/...
+// streams counts the streams this node is relaying or exiting.
+var streams atomic.Int64
+
+// Streams returns how many streams this node is relaying or exiting, which it
+// advertises as its load.
+func Streams() uint64 {
+	return uint64(streams.Load())
+}
+
+// Register /PureGamer/relay/<version>, the route follows in a signed header
 func Register(node *model.Node, exits *exit.Exit) error {
-	node.Host.SetStreamHandlerMatch("/PureGamer/relay/"+version, match, getHandler(node, exits))
+	node.Host.SetStreamHandler(protocolId, getHandler(node, exits))
 	return nil
 }
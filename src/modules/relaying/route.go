@@ -0,0 +1,175 @@
+package relaying
+
+import (
+	"errors"
+	"fmt"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/modules/exit"
+	"github.com/GlazeLab/PureGamer/src/modules/tunnel"
+	"github.com/GlazeLab/PureGamer/src/utils"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"time"
+)
+
+// newHeader signs one ticket for every hop of the route.
+func newHeader(n *model.Node, target exit.Target, hops []string) (model.RouteHeader, error) {
+	if len(hops) > maxHops {
+		return model.RouteHeader{}, fmt.Errorf("route of %d hops is longer than %d", len(hops), maxHops)
+	}
+	priv := n.Host.Peerstore().PrivKey(n.Host.ID())
+	if priv == nil {
+		return model.RouteHeader{}, errors.New("private key of this node is missing")
+	}
+
+	entry := n.Host.ID().String()
+	expire := time.Now().Add(ticketTTL).Unix()
+	header := model.RouteHeader{Tickets: make([]model.SignedTicket, len(hops))}
+	prev := entry
+	for i, hop := range hops {
+		ticket := model.RouteTicket{
+			GameID: target.GameID,
+			Entry:  entry,
+			Prev:   prev,
+			Hop:    hop,
+			TTL:    uint8(len(hops) - 1 - i),
+			Expire: expire,
+		}
+		if i+1 < len(hops) {
+			ticket.Next = hops[i+1]
+		} else {
+			ticket.Client = target.Client
+			ticket.Backend = target.Backend
+			ticket.Session = target.Session
+		}
+		ticketBytes, err := msgpack.Marshal(ticket)
+		if err != nil {
+			return model.RouteHeader{}, err
+		}
+		sign, err := priv.Sign(ticketBytes)
+		if err != nil {
+			return model.RouteHeader{}, err
+		}
+		header.Tickets[i] = model.SignedTicket{Ticket: ticketBytes, Sign: sign}
+		prev = hop
+	}
+	return header, nil
+}
+
+// checkHeader verifies the ticket addressed to this node, received from peer
+// from, and returns it.
+func checkHeader(n *model.Node, header model.RouteHeader, from peer.ID) (*model.RouteTicket, error) {
+	if len(header.Tickets) == 0 || len(header.Tickets) > maxHops {
+		return nil, fmt.Errorf("route of %d hops is not allowed", len(header.Tickets))
+	}
+	signed := header.Tickets[0]
+	var ticket model.RouteTicket
+	err := msgpack.Unmarshal(signed.Ticket, &ticket)
+	if err != nil {
+		return nil, err
+	}
+
+	pubKey, err := entryKey(n, ticket.Entry)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := pubKey.Verify(signed.Ticket, signed.Sign)
+	if err != nil || !ok {
+		return nil, errors.New("route ticket has an invalid signature")
+	}
+
+	switch {
+	case ticket.Hop != n.Host.ID().String():
+		return nil, errors.New("route ticket is for another hop")
+	case ticket.Prev != from.String():
+		return nil, errors.New("route ticket was sent by an unexpected peer")
+	case int(ticket.TTL) != len(header.Tickets)-1 || (ticket.TTL == 0) != (ticket.Next == ""):
+		return nil, errors.New("route ticket hop limit does not match the route")
+	case time.Now().Unix() > ticket.Expire:
+		return nil, errors.New("route ticket has expired")
+	}
+	return &ticket, nil
+}
+
+func entryKey(n *model.Node, entry string) (crypto.PubKey, error) {
+	entryId, err := peer.Decode(entry)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, err := entryId.ExtractPublicKey()
+	if err == nil {
+		return pubKey, nil
+	}
+	pubKey = n.Host.Peerstore().PubKey(entryId)
+	if pubKey == nil {
+		return nil, fmt.Errorf("public key of entry %s is unknown", entry)
+	}
+	return pubKey, nil
+}
+
+func writeMessage(w io.Writer, v interface{}) error {
+	msg, err := msgpack.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tunnel.WriteFrame(w, msg)
+}
+
+func readMessage(r io.Reader, v interface{}) error {
+	buf := make([]byte, tunnel.MaxFrameSize)
+	size, err := tunnel.ReadFrame(r, buf)
+	if err != nil {
+		return err
+	}
+	return msgpack.Unmarshal(buf[:size], v)
+}
+
+// authorize checks that the entry node of the ticket may use this node for
+// the game, and when this node is the exit, that it may exit the game.
+func authorize(n *model.Node, exits *exit.Exit, ticket *model.RouteTicket) error {
+	game, ok := exits.Game(ticket.GameID)
+	if !ok {
+		return fmt.Errorf("game %s is unknown", ticket.GameID)
+	}
+	if utils.IsNotAllowed(ticket.Entry, game.EntryNode) {
+		return fmt.Errorf("entry node %s is not allowed for game %s", ticket.Entry, ticket.GameID)
+	}
+	if ticket.Next == "" && utils.IsNotAllowed(n.Host.ID().String(), game.ExitNode) {
+		return fmt.Errorf("node %s is not an exit node for game %s", n.Host.ID(), ticket.GameID)
+	}
+	return nil
+}
+
+// RouteError is returned by OpenRelay when a hop rejects the route.
+type RouteError struct {
+	Code    uint8
+	Message string
+}
+
+func (e *RouteError) Error() string {
+	return fmt.Sprintf("route rejected: %s", e.Message)
+}
+
+// writeStatus tells the previous hop whether the route was accepted.
+func writeStatus(w io.Writer, code uint8, err error) error {
+	status := model.RouteStatus{Code: code}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	return writeMessage(w, status)
+}
+
+// readStatus returns the RouteError a hop rejected the route with, if any.
+func readStatus(r io.Reader) error {
+	var status model.RouteStatus
+	err := readMessage(r, &status)
+	if err != nil {
+		return err
+	}
+	if status.Code != model.RouteAccepted {
+		return &RouteError{Code: status.Code, Message: status.Error}
+	}
+	return nil
+}
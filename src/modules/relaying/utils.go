@@ -2,40 +2,50 @@ package relaying
 
 import (
 	"context"
-	"fmt"
 	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/modules/exit"
 	"github.com/libp2p/go-libp2p/core/network"
 	"github.com/libp2p/go-libp2p/core/peer"
-	"github.com/libp2p/go-libp2p/core/protocol"
+	"time"
 )
 
-func OpenRelay(ctx context.Context, n *model.Node, gameId string, relayNodes []string) (network.Stream, error) {
+func OpenRelay(ctx context.Context, n *model.Node, target exit.Target, relayNodes []string) (network.Stream, error) {
 	// the first node is what you want to connect to
 	// the last node should be the exit node
-	var firstRelayPeerId peer.ID
-	var err error
-	if len(relayNodes) == 0 {
-		firstRelayPeerId = n.Host.ID()
-	} else {
-		firstRelayPeerId, err = peer.Decode(relayNodes[0])
-		if err != nil {
-			return nil, err
-		}
+	hops := relayNodes
+	if len(hops) == 0 {
+		hops = []string{n.Host.ID().String()}
+	}
+	firstRelayPeerId, err := peer.Decode(hops[0])
+	if err != nil {
+		return nil, err
 	}
 
-	// build the protocol id
-	protocolId := fmt.Sprintf("/PureGamer/relay/%s/game/%s", version, gameId)
-	if len(relayNodes) > 1 {
-		for _, peerId := range relayNodes[1:] {
-			protocolId += fmt.Sprintf("/next/%s", peerId)
-		}
+	header, err := newHeader(n, target, hops)
+	if err != nil {
+		return nil, err
 	}
 
-	relayStream, err := n.Host.NewStream(context.TODO(), firstRelayPeerId, protocol.ID(protocolId))
+	relayStream, err := n.Host.NewStream(ctx, firstRelayPeerId, protocolId)
 	if err != nil {
 		return nil, err
 	}
 	relayStream.Scope().SetService(ServiceName)
 
+	err = writeMessage(relayStream, header)
+	if err != nil {
+		relayStream.Reset()
+		return nil, err
+	}
+
+	// wait for the exit node to accept the route
+	relayStream.SetReadDeadline(time.Now().Add(headerTimeout * time.Duration(len(hops))))
+	err = readStatus(relayStream)
+	relayStream.SetReadDeadline(time.Time{})
+	if err != nil {
+		relayStream.Reset()
+		return nil, err
+	}
+
 	return relayStream, nil
 }
@@ -0,0 +1,163 @@
+package session
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	logging "github.com/ipfs/go-log/v2"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var log = logging.Logger("session")
+
+var ErrNotFound = errors.New("session not found")
+
+// Session is one player connection served by this entry node.
+type Session struct {
+	ID      string
+	Client  string
+	GameID  string
+	Started time.Time
+
+	route     atomic.Pointer[[]string]
+	bytesUp   atomic.Uint64
+	bytesDown atomic.Uint64
+	kick      func()
+}
+
+// Info is a snapshot of a Session for listing.
+type Info struct {
+	ID        string    `json:"id"`
+	Client    string    `json:"client"`
+	GameID    string    `json:"game_id"`
+	Route     []string  `json:"route"`
+	Started   time.Time `json:"started"`
+	BytesUp   uint64    `json:"bytes_up"`
+	BytesDown uint64    `json:"bytes_down"`
+}
+
+// SetRoute records the relay nodes the session goes through, empty when
+// the entry node is also the exit.
+func (s *Session) SetRoute(route []string) {
+	route = append([]string{}, route...)
+	s.route.Store(&route)
+}
+
+// AddUp counts bytes sent from the player to the game server.
+func (s *Session) AddUp(n int) {
+	s.bytesUp.Add(uint64(n))
+}
+
+// AddDown counts bytes sent from the game server to the player.
+func (s *Session) AddDown(n int) {
+	s.bytesDown.Add(uint64(n))
+}
+
+// Wrap counts what is read from the player connection as sent up and what
+// is written to it as sent down.
+func (s *Session) Wrap(conn io.ReadWriteCloser) io.ReadWriteCloser {
+	return &counter{ReadWriteCloser: conn, s: s}
+}
+
+func (s *Session) Info() Info {
+	var route []string
+	if r := s.route.Load(); r != nil {
+		route = *r
+	}
+	return Info{
+		ID:        s.ID,
+		Client:    s.Client,
+		GameID:    s.GameID,
+		Route:     route,
+		Started:   s.Started,
+		BytesUp:   s.bytesUp.Load(),
+		BytesDown: s.bytesDown.Load(),
+	}
+}
+
+type counter struct {
+	io.ReadWriteCloser
+	s *Session
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.s.AddUp(n)
+	return n, err
+}
+
+func (c *counter) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.s.AddDown(n)
+	return n, err
+}
+
+// Registry keeps track of the active sessions of this node.
+type Registry struct {
+	lock     sync.RWMutex
+	sessions map[string]*Session
+}
+
+func NewRegistry() *Registry {
+	return &Registry{sessions: make(map[string]*Session)}
+}
+
+// Open registers a new session. kick is called to force it to disconnect.
+func (r *Registry) Open(client string, gameId string, kick func()) *Session {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Errorf("failed to get cryptographic random: %s", err)
+	}
+	s := &Session{
+		ID:      hex.EncodeToString(id),
+		Client:  client,
+		GameID:  gameId,
+		Started: time.Now(),
+		kick:    kick,
+	}
+	r.lock.Lock()
+	r.sessions[s.ID] = s
+	r.lock.Unlock()
+	log.Infof("Session %s opened from %s for %s", s.ID, client, gameId)
+	return s
+}
+
+// Close removes a session once its connection is gone.
+func (r *Registry) Close(s *Session) {
+	r.lock.Lock()
+	delete(r.sessions, s.ID)
+	r.lock.Unlock()
+	info := s.Info()
+	log.Infof("Session %s closed after %s, %d bytes up, %d bytes down", s.ID, time.Since(s.Started), info.BytesUp, info.BytesDown)
+}
+
+// List returns the active sessions, oldest first.
+func (r *Registry) List() []Info {
+	r.lock.RLock()
+	infos := make([]Info, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		infos = append(infos, s.Info())
+	}
+	r.lock.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// Kick forces the session with the given ID to disconnect.
+func (r *Registry) Kick(id string) error {
+	r.lock.RLock()
+	s, ok := r.sessions[id]
+	r.lock.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	log.Infof("Kicking session %s", id)
+	s.kick()
+	return nil
+}
@@ -2,16 +2,22 @@ package superadmin
 
 import (
 	"context"
-	"crypto/ecdsa"
+	"crypto"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/GlazeLab/PureGamer/src/model"
-	"github.com/GlazeLab/PureGamer/src/utils"
 	"github.com/vmihailenco/msgpack/v5"
 	"os"
+	"time"
 )
 
 func (su *SuperAdmin) Handle(ctx context.Context) <-chan error {
 	errCh := make(chan error)
+	go su.catchUp(ctx)
+	go su.announce(ctx)
+	go su.handleDigests(ctx)
+	go su.handleRotations(ctx)
 	go func() {
 		for {
 			msg, err := su.sub.Next(ctx)
@@ -27,7 +33,19 @@ func (su *SuperAdmin) Handle(ctx context.Context) <-chan error {
 				errCh <- err
 				continue
 			}
-			err = su.handleConfig(signedConfig)
+			// verified by the validator already
+			var config model.Config
+			err = msgpack.Unmarshal(signedConfig.Config, &config)
+			if err != nil {
+				log.Error(err)
+				errCh <- err
+				continue
+			}
+			err = su.handleConfig(msg.GetData(), signedConfig, config)
+			if errors.Is(err, errNotNewer) {
+				log.Warn(err)
+				continue
+			}
 			if err != nil {
 				log.Error(err)
 				errCh <- err
@@ -38,51 +56,92 @@ func (su *SuperAdmin) Handle(ctx context.Context) <-chan error {
 	return errCh
 }
 
-func (su *SuperAdmin) handleConfig(signedConfig model.SignedConfig) error {
-	su.n.Config = &signedConfig.Config
-	var err error
+// handleConfig applies config, opened from signedConfig already, and keeps
+// data, the encoding of signedConfig, for peers that missed it. Every
+// callback runs even when some fail, and their errors are returned together.
+// The version is recorded only once the config is written, so that a node
+// stopping on the way takes the config again.
+func (su *SuperAdmin) handleConfig(data []byte, signedConfig model.SignedConfig, config model.Config) error {
+	su.lock.Lock()
+	defer su.lock.Unlock()
+	// configs may pass the validator together, only the newest is applied
+	if !su.validator.fresh(signedConfig, config) {
+		return fmt.Errorf("%w: %d, applied %d", errNotNewer, config.Version, su.version.current())
+	}
+	log.Infof("Applying config %d issued at %s", config.Version, time.UnixMilli(config.IssuedAt))
+	su.n.Config = &config
+	// a module failing to follow the config, say to bind a port, must not
+	// keep the others from following it
+	var errs []error
 	for _, cb := range su.n.FlushConfigCallbacks {
-		err = cb(signedConfig.Config)
-		if err != nil {
-			return err
-		}
+		errs = append(errs, cb(config))
 	}
-	// write to file
-	var file *os.File
-	file, err = os.Create(su.n.FixedConfig.ConfigPath)
+	err := writeConfig(su.n.FixedConfig.ConfigPath, config)
 	if err != nil {
-		return err
+		return errors.Join(append(errs, err)...)
 	}
-	defer file.Close()
-	enc := json.NewEncoder(file)
-	err = enc.Encode(signedConfig.Config)
+	err = su.version.apply(su.n.CTX, config, signedConfig.Config)
 	if err != nil {
-		return err
+		return errors.Join(append(errs, err)...)
 	}
-	return nil
+	err = su.remember(su.n.CTX, data, signedConfig, config)
+	if err != nil {
+		log.Error(err)
+	}
+	return errors.Join(errs...)
 }
 
-func (su *SuperAdmin) SendConfig(ctx context.Context, config model.Config, privKey *ecdsa.PrivateKey) error {
-	configBytes, err := msgpack.Marshal(config)
+// writeConfig writes config to the file the node reads it from on start.
+// Fields the node does not know are lost, they are only kept in the signed
+// config remembered for peers.
+func writeConfig(path string, config model.Config) error {
+	file, err := os.Create(path)
 	if err != nil {
 		return err
 	}
-	sign, err := utils.Sign(configBytes, privKey)
+	defer file.Close()
+	enc := json.NewEncoder(file)
+	return enc.Encode(config)
+}
+
+// SendConfig signs config with privKey and publishes it once enough admins
+// signed it: right away when one is enough, or when other admins co-sign its
+// proposal. A config without a version newer than the applied one gets the
+// next version. It returns the id of the proposal.
+func (su *SuperAdmin) SendConfig(ctx context.Context, config model.Config, privKey crypto.Signer) (string, error) {
+	config.Version = max(config.Version, su.version.current()+1)
+	config.IssuedAt = time.Now().UnixMilli()
+	payload, err := msgpack.Marshal(config)
 	if err != nil {
-		return err
+		return "", err
 	}
-	signedConfig := model.SignedConfig{
-		Config: config,
-		Sign:   sign,
+	proposal := model.Proposal{Kind: model.ProposeConfig, Payload: payload}
+	err = signProposal(&proposal, privKey)
+	if err != nil {
+		return "", err
 	}
-	msg, err := msgpack.Marshal(signedConfig)
+	return su.submit(ctx, proposal)
+}
+
+// SendKeyRotation signs rotation with privKey as the one following the last
+// rotation applied, and publishes it like SendConfig. privKey must be trusted
+// already.
+func (su *SuperAdmin) SendKeyRotation(ctx context.Context, rotation model.KeyRotation, privKey crypto.Signer) (string, error) {
+	rotation.Seq = su.keys.current() + 1
+	rotation.IssuedAt = time.Now().UnixMilli()
+	payload, err := msgpack.Marshal(rotation)
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = su.top.Publish(ctx, msg)
+	proposal := model.Proposal{Kind: model.ProposeKeyRotation, Payload: payload}
+	err = signProposal(&proposal, privKey)
 	if err != nil {
-		return err
+		return "", err
 	}
-	log.Info("Sent config to superadmin")
-	return nil
+	return su.submit(ctx, proposal)
+}
+
+// Keys returns the ids of the trusted admin keys, see utils.KeyID.
+func (su *SuperAdmin) Keys() []string {
+	return su.keys.ids()
 }
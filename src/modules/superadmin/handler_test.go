@@ -0,0 +1,57 @@
+package superadmin
+
+import (
+	"errors"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/vmihailenco/msgpack/v5"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHandleConfigRunsEveryCallback(t *testing.T) {
+	su, privKey := newTestAdmin(t, time.Time{})
+	errBind := errors.New("cannot bind")
+	var called []string
+	su.n.FlushConfigCallbacks = []func(model.Config) error{
+		func(model.Config) error {
+			called = append(called, "first")
+			return errBind
+		},
+		func(model.Config) error {
+			called = append(called, "second")
+			return nil
+		},
+	}
+
+	data := modernMessage(t, privKey, model.Config{Version: 1})
+	var signedConfig model.SignedConfig
+	err := msgpack.Unmarshal(data, &signedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := su.validator.open(signedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = su.handleConfig(data, signedConfig, config)
+	if !errors.Is(err, errBind) {
+		t.Errorf("error %v, want the one of the failing callback", err)
+	}
+	if len(called) != 2 {
+		t.Errorf("callbacks called: %v, want both", called)
+	}
+	if _, err := os.Stat(su.n.FixedConfig.ConfigPath); err != nil {
+		t.Errorf("config not written: %v", err)
+	}
+	if got := su.version.current(); got != 1 {
+		t.Errorf("applied version %d, want 1", got)
+	}
+
+	// the config is not applied again, its error would repeat
+	err = su.handleConfig(data, signedConfig, config)
+	if !errors.Is(err, errNotNewer) {
+		t.Errorf("error %v applying the config again, want errNotNewer", err)
+	}
+}
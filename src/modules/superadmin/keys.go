@@ -0,0 +1,326 @@
+package superadmin
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/utils"
+	"github.com/ipfs/go-datastore"
+	dbstore "github.com/ipfs/go-ds-leveldb"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/vmihailenco/msgpack/v5"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// keysTopicName carries the signed key rotations.
+const keysTopicName = "/PureGamer/superadmin/keys"
+
+var rotationsKey = datastore.NewKey("/superadmin/rotations")
+
+var (
+	errKeyGap    = errors.New("key rotation does not follow the applied one")
+	errThreshold = errors.New("not signed by enough admin keys")
+	errLegacyMD5 = errors.New("signatures over MD5 are only accepted as the single signature of older configs")
+)
+
+// keyring holds the admin keys trusted to sign configs: those of the fixed
+// config, changed by the key rotations applied since, in order.
+type keyring struct {
+	lock  sync.RWMutex
+	store *dbstore.Datastore
+	keys  map[string]crypto.PublicKey
+	// threshold is how many keys must sign a config or rotation.
+	threshold int
+	seq       uint64
+	// rotations are the encoded SignedKeyRotation applied, the one of Seq n
+	// at index n-1.
+	rotations [][]byte
+}
+
+func decodeKeys(pems []string) (map[string]crypto.PublicKey, error) {
+	keys := make(map[string]crypto.PublicKey)
+	for _, pem := range pems {
+		key, err := utils.DecodePublicKey(pem)
+		if err != nil {
+			return nil, err
+		}
+		id, err := utils.KeyID(key)
+		if err != nil {
+			return nil, err
+		}
+		keys[id] = key
+	}
+	return keys, nil
+}
+
+// loadKeyring trusts the admin keys of the fixed config, and replays the key
+// rotations stored by the node over them.
+func loadKeyring(ctx context.Context, n *model.Node) (*keyring, error) {
+	fixed := n.FixedConfig.AdminPubKeys
+	if n.FixedConfig.SuperAdminPubKey != "" {
+		fixed = append([]string{n.FixedConfig.SuperAdminPubKey}, fixed...)
+	}
+	keys, err := decodeKeys(fixed)
+	if err != nil {
+		return nil, err
+	}
+	threshold := int(max(n.FixedConfig.AdminThreshold, 1))
+	if len(keys) < threshold {
+		return nil, fmt.Errorf("%d admin keys are needed to sign configs, only %d are trusted", threshold, len(keys))
+	}
+	k := &keyring{store: n.Store, keys: keys, threshold: threshold}
+	if n.Store == nil {
+		return k, nil
+	}
+
+	data, err := n.Store.Get(ctx, rotationsKey)
+	if err == datastore.ErrNotFound {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rotations [][]byte
+	err = msgpack.Unmarshal(data, &rotations)
+	if err != nil {
+		return nil, err
+	}
+	for _, rotation := range rotations {
+		err = k.apply(rotation)
+		if err != nil {
+			log.Warnf("Dropped the key rotations from %d: %s", k.seq+1, err)
+			break
+		}
+	}
+	return k, nil
+}
+
+// modernOnly rejects signatures over MD5. Configs sent by older versions
+// carry theirs in SignedConfig.Sign, the only place MD5 is accepted.
+func modernOnly(signatures []model.Signature) error {
+	for _, signature := range signatures {
+		if signature.Algorithm == utils.LegacyAlgorithm {
+			return errLegacyMD5
+		}
+	}
+	return nil
+}
+
+// signers returns the ids of the trusted keys that made signatures over
+// message, each key once. Signatures without a key id are checked against
+// every key.
+func (k *keyring) signers(message []byte, signatures []model.Signature) map[string]struct{} {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.signersLocked(message, signatures)
+}
+
+func (k *keyring) signersLocked(message []byte, signatures []model.Signature) map[string]struct{} {
+	signers := make(map[string]struct{})
+	for _, signature := range signatures {
+		if signature.KeyID != "" {
+			key, ok := k.keys[signature.KeyID]
+			if ok && utils.VerifyWith(signature.Algorithm, message, signature.Sign, key) {
+				signers[signature.KeyID] = struct{}{}
+			}
+			continue
+		}
+		for id, key := range k.keys {
+			if _, ok := signers[id]; ok {
+				continue
+			}
+			if utils.VerifyWith(signature.Algorithm, message, signature.Sign, key) {
+				signers[id] = struct{}{}
+				break
+			}
+		}
+	}
+	return signers
+}
+
+// approved checks that at least threshold trusted keys made signatures over
+// message.
+func (k *keyring) approved(message []byte, signatures []model.Signature) error {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.approvedLocked(message, signatures)
+}
+
+func (k *keyring) approvedLocked(message []byte, signatures []model.Signature) error {
+	signers := len(k.signersLocked(message, signatures))
+	if signers == 0 {
+		return errBadSignature
+	}
+	if signers < k.threshold {
+		return fmt.Errorf("%w: %d of %d", errThreshold, signers, k.threshold)
+	}
+	return nil
+}
+
+func (k *keyring) current() uint64 {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return k.seq
+}
+
+// ids returns the ids of the trusted keys.
+func (k *keyring) ids() []string {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// since returns the encoded rotations after seq.
+func (k *keyring) since(seq uint64) [][]byte {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	if seq >= k.seq {
+		return nil
+	}
+	return slices.Clone(k.rotations[seq:])
+}
+
+// openLocked verifies that signed is signed by enough trusted keys, over
+// SHA-256 or with Ed25519, and only then decodes its rotation, which must be
+// newer than the applied one.
+func (k *keyring) openLocked(signed model.SignedKeyRotation) (model.KeyRotation, error) {
+	var rotation model.KeyRotation
+	err := modernOnly(signed.Signatures)
+	if err != nil {
+		return rotation, err
+	}
+	err = k.approvedLocked(signed.Rotation, signed.Signatures)
+	if err != nil {
+		return rotation, err
+	}
+	err = msgpack.Unmarshal(signed.Rotation, &rotation)
+	if err != nil {
+		return rotation, err
+	}
+	if rotation.Seq <= k.seq {
+		return rotation, fmt.Errorf("%w: key rotation %d, applied %d", errNotNewer, rotation.Seq, k.seq)
+	}
+	issued := time.UnixMilli(rotation.IssuedAt)
+	if issued.After(time.Now().Add(clockSkew)) {
+		return rotation, fmt.Errorf("key rotation %d is dated %s", rotation.Seq, issued)
+	}
+	return rotation, nil
+}
+
+// apply applies data, an encoded SignedKeyRotation, when it follows the last
+// rotation applied.
+func (k *keyring) apply(data []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.applyLocked(data)
+}
+
+func (k *keyring) applyLocked(data []byte) error {
+	var signed model.SignedKeyRotation
+	err := msgpack.Unmarshal(data, &signed)
+	if err != nil {
+		return err
+	}
+	rotation, err := k.openLocked(signed)
+	if err != nil {
+		return err
+	}
+	if rotation.Seq != k.seq+1 {
+		return fmt.Errorf("%w: key rotation %d, applied %d", errKeyGap, rotation.Seq, k.seq)
+	}
+
+	added, err := decodeKeys(rotation.Add)
+	if err != nil {
+		return err
+	}
+	revoked, err := decodeKeys(rotation.Revoke)
+	if err != nil {
+		return err
+	}
+	keys := maps.Clone(k.keys)
+	maps.Copy(keys, added)
+	for id := range revoked {
+		delete(keys, id)
+	}
+	if len(keys) < k.threshold {
+		return fmt.Errorf("key rotation %d would leave %d admin keys, %d are needed", rotation.Seq, len(keys), k.threshold)
+	}
+	log.Infof("Applying key rotation %d: %d keys added, %d revoked", rotation.Seq, len(added), len(revoked))
+	k.keys = keys
+	k.seq = rotation.Seq
+	k.rotations = append(k.rotations, data)
+	return nil
+}
+
+// rotate applies data like apply, and stores the rotations applied.
+func (k *keyring) rotate(ctx context.Context, data []byte) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	err := k.applyLocked(data)
+	if err != nil {
+		return err
+	}
+	if k.store == nil {
+		return nil
+	}
+	rotations, err := msgpack.Marshal(k.rotations)
+	if err != nil {
+		return err
+	}
+	return k.store.Put(ctx, rotationsKey, rotations)
+}
+
+// validate accepts key rotations newer than the applied one that are signed
+// by enough trusted keys. Rotations skipping some are let through, the handler
+// syncs the missing ones.
+func (k *keyring) validate(ctx context.Context, p peer.ID, msg *pubsub.Message) bool {
+	var signed model.SignedKeyRotation
+	err := msgpack.Unmarshal(msg.GetData(), &signed)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	k.lock.RLock()
+	_, err = k.openLocked(signed)
+	k.lock.RUnlock()
+	if err != nil {
+		log.Warnf("Rejected key rotation from %s: %s", msg.GetFrom(), err)
+		return false
+	}
+	return true
+}
+
+// handleRotations applies the key rotations broadcast, and syncs from their
+// sender those that were missed.
+func (su *SuperAdmin) handleRotations(ctx context.Context) {
+	for {
+		msg, err := su.keysSub.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error(err)
+			continue
+		}
+		err = su.keys.rotate(su.n.CTX, msg.GetData())
+		switch {
+		case errors.Is(err, errKeyGap):
+			log.Info(err)
+			go su.syncFrom(ctx, sources(msg))
+		case errors.Is(err, errNotNewer):
+		case err != nil:
+			log.Error(err)
+		}
+	}
+}
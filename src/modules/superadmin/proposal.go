@@ -0,0 +1,311 @@
+package superadmin
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/utils"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/vmihailenco/msgpack/v5"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	// proposalsTopicName carries the proposals waiting for co-signatures.
+	proposalsTopicName = "/PureGamer/superadmin/proposals"
+	// proposalTTL is how long a proposal waits for co-signatures.
+	proposalTTL = 24 * time.Hour
+)
+
+var ErrNoProposal = errors.New("proposal not found")
+
+// PendingProposal is a proposal waiting for co-signatures, as listed to the
+// admins.
+type PendingProposal struct {
+	ID       string             `json:"id"`
+	Kind     string             `json:"kind"`
+	Config   *model.Config      `json:"config,omitempty"`
+	Rotation *model.KeyRotation `json:"rotation,omitempty"`
+	Signers  []string           `json:"signers"`
+	Received time.Time          `json:"received"`
+}
+
+type pending struct {
+	proposal model.Proposal
+	received time.Time
+}
+
+func proposalID(proposal model.Proposal) string {
+	h := sha256.New()
+	h.Write([]byte(proposal.Kind))
+	h.Write([]byte{0})
+	h.Write(proposal.Payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signProposal adds the signature of privKey to proposal, replacing an
+// earlier one of the same key.
+func signProposal(proposal *model.Proposal, privKey crypto.Signer) error {
+	id, err := utils.KeyID(privKey.Public())
+	if err != nil {
+		return err
+	}
+	algorithm, sign, err := utils.SignWith(proposal.Payload, privKey)
+	if err != nil {
+		return err
+	}
+	proposal.Signatures = slices.DeleteFunc(slices.Clone(proposal.Signatures), func(signature model.Signature) bool {
+		return signature.KeyID == id
+	})
+	proposal.Signatures = append(proposal.Signatures, model.Signature{KeyID: id, Algorithm: algorithm, Sign: sign})
+	return nil
+}
+
+// checkProposal verifies that the payload of proposal is newer than what the
+// node applied and returns how many trusted keys signed it.
+func (su *SuperAdmin) checkProposal(proposal model.Proposal) (int, error) {
+	switch proposal.Kind {
+	case model.ProposeConfig:
+		var config model.Config
+		err := msgpack.Unmarshal(proposal.Payload, &config)
+		if err != nil {
+			return 0, err
+		}
+		if !su.version.newer(config) {
+			return 0, fmt.Errorf("%w: config %d, applied %d", errNotNewer, config.Version, su.version.current())
+		}
+	case model.ProposeKeyRotation:
+		var rotation model.KeyRotation
+		err := msgpack.Unmarshal(proposal.Payload, &rotation)
+		if err != nil {
+			return 0, err
+		}
+		if rotation.Seq <= su.keys.current() {
+			return 0, fmt.Errorf("%w: key rotation %d, applied %d", errNotNewer, rotation.Seq, su.keys.current())
+		}
+	default:
+		return 0, fmt.Errorf("unknown proposal kind %q", proposal.Kind)
+	}
+	err := modernOnly(proposal.Signatures)
+	if err != nil {
+		return 0, err
+	}
+	signers := len(su.keys.signers(proposal.Payload, proposal.Signatures))
+	if signers == 0 {
+		return 0, errBadSignature
+	}
+	return signers, nil
+}
+
+// validateProposal accepts proposals that are newer than what the node
+// applied and signed by at least one trusted key.
+func (su *SuperAdmin) validateProposal(ctx context.Context, p peer.ID, msg *pubsub.Message) bool {
+	var proposal model.Proposal
+	err := msgpack.Unmarshal(msg.GetData(), &proposal)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	_, err = su.checkProposal(proposal)
+	if err != nil {
+		log.Warnf("Rejected proposal from %s: %s", msg.GetFrom(), err)
+		return false
+	}
+	return true
+}
+
+// track merges the valid signatures of proposal into the pending proposal
+// with the same payload, and returns the merged proposal.
+func (su *SuperAdmin) track(proposal model.Proposal) model.Proposal {
+	su.proposalLock.Lock()
+	defer su.proposalLock.Unlock()
+	su.pruneLocked()
+	now := time.Now()
+	id := proposalID(proposal)
+	p, ok := su.proposals[id]
+	if !ok {
+		p = &pending{proposal: model.Proposal{Kind: proposal.Kind, Payload: proposal.Payload}, received: now}
+		su.proposals[id] = p
+	}
+	for _, signature := range proposal.Signatures {
+		if signature.KeyID == "" || signature.Algorithm == utils.LegacyAlgorithm || slices.ContainsFunc(p.proposal.Signatures, func(known model.Signature) bool {
+			return known.KeyID == signature.KeyID
+		}) {
+			continue
+		}
+		if _, ok := su.keys.signers(proposal.Payload, []model.Signature{signature})[signature.KeyID]; !ok {
+			continue
+		}
+		p.proposal.Signatures = append(p.proposal.Signatures, signature)
+	}
+	merged := p.proposal
+	merged.Signatures = slices.Clone(merged.Signatures)
+	return merged
+}
+
+// pruneLocked drops the proposals that expired or that are not newer than
+// what the node applied anymore.
+func (su *SuperAdmin) pruneLocked() {
+	for id, p := range su.proposals {
+		_, err := su.checkProposal(p.proposal)
+		if time.Since(p.received) > proposalTTL || errors.Is(err, errNotNewer) {
+			delete(su.proposals, id)
+		}
+	}
+}
+
+func (su *SuperAdmin) forget(id string) {
+	su.proposalLock.Lock()
+	defer su.proposalLock.Unlock()
+	delete(su.proposals, id)
+}
+
+// submit publishes proposal as a signed config or key rotation when enough
+// admins signed it, and for co-signing otherwise. It returns the id of the
+// proposal.
+func (su *SuperAdmin) submit(ctx context.Context, proposal model.Proposal) (string, error) {
+	_, err := su.checkProposal(proposal)
+	if err != nil {
+		return "", err
+	}
+	id := proposalID(proposal)
+	// signatures broadcast by other admins count too
+	proposal = su.track(proposal)
+	signers := len(su.keys.signers(proposal.Payload, proposal.Signatures))
+	if signers >= su.keys.threshold {
+		return id, su.publish(ctx, id, proposal)
+	}
+
+	msg, err := msgpack.Marshal(proposal)
+	if err != nil {
+		return "", err
+	}
+	err = su.proposalsTop.Publish(ctx, msg)
+	if err != nil {
+		return "", err
+	}
+	log.Infof("Proposed %s %s, signed by %d of %d admins", proposal.Kind, id, signers, su.keys.threshold)
+	return id, nil
+}
+
+// publish broadcasts proposal, signed by enough admins, as what it proposes.
+func (su *SuperAdmin) publish(ctx context.Context, id string, proposal model.Proposal) error {
+	var msg []byte
+	var err error
+	top := su.top
+	// the payload is passed on as it was signed
+	switch proposal.Kind {
+	case model.ProposeConfig:
+		msg, err = msgpack.Marshal(model.SignedConfig{Config: proposal.Payload, Signatures: proposal.Signatures})
+	case model.ProposeKeyRotation:
+		msg, err = msgpack.Marshal(model.SignedKeyRotation{Rotation: proposal.Payload, Signatures: proposal.Signatures})
+		top = su.keysTop
+	}
+	if err != nil {
+		return err
+	}
+	su.forget(id)
+	err = top.Publish(ctx, msg)
+	if err != nil {
+		return err
+	}
+	log.Infof("Sent %s %s to superadmin", proposal.Kind, id)
+	return nil
+}
+
+// HandleProposals keeps track of the proposals broadcast, so that they can
+// be listed and co-signed, and publishes those that collected enough
+// signatures. Only admin nodes need to call it.
+func (su *SuperAdmin) HandleProposals(ctx context.Context) error {
+	sub, err := su.proposalsTop.Subscribe()
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			msg, err := sub.Next(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Error(err)
+				continue
+			}
+			var proposal model.Proposal
+			err = msgpack.Unmarshal(msg.GetData(), &proposal)
+			if err != nil {
+				log.Warn(err)
+				continue
+			}
+			proposal = su.track(proposal)
+			signers, err := su.checkProposal(proposal)
+			if err != nil {
+				log.Warn(err)
+				continue
+			}
+			if signers < su.keys.threshold {
+				continue
+			}
+			err = su.publish(ctx, proposalID(proposal), proposal)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}()
+	return nil
+}
+
+// CoSign adds the signature of privKey to the pending proposal id, and
+// publishes it when enough admins signed it.
+func (su *SuperAdmin) CoSign(ctx context.Context, id string, privKey crypto.Signer) error {
+	su.proposalLock.Lock()
+	p, ok := su.proposals[id]
+	var proposal model.Proposal
+	if ok {
+		proposal = p.proposal
+	}
+	su.proposalLock.Unlock()
+	if !ok {
+		return ErrNoProposal
+	}
+	err := signProposal(&proposal, privKey)
+	if err != nil {
+		return err
+	}
+	_, err = su.submit(ctx, proposal)
+	return err
+}
+
+// Proposals lists the pending proposals, oldest first.
+func (su *SuperAdmin) Proposals() []PendingProposal {
+	su.proposalLock.Lock()
+	su.pruneLocked()
+	proposals := make([]PendingProposal, 0, len(su.proposals))
+	for id, p := range su.proposals {
+		info := PendingProposal{ID: id, Kind: p.proposal.Kind, Received: p.received}
+		switch p.proposal.Kind {
+		case model.ProposeConfig:
+			info.Config = &model.Config{}
+			_ = msgpack.Unmarshal(p.proposal.Payload, info.Config)
+		case model.ProposeKeyRotation:
+			info.Rotation = &model.KeyRotation{}
+			_ = msgpack.Unmarshal(p.proposal.Payload, info.Rotation)
+		}
+		for _, signature := range p.proposal.Signatures {
+			info.Signers = append(info.Signers, signature.KeyID)
+		}
+		proposals = append(proposals, info)
+	}
+	su.proposalLock.Unlock()
+	sort.Slice(proposals, func(i, j int) bool {
+		return proposals[i].Received.Before(proposals[j].Received)
+	})
+	return proposals
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/GlazeLab/PureGamer/src/model"
 	logging "github.com/ipfs/go-log/v2"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"sync"
 )
 
 var log = logging.Logger("superadmin")
@@ -11,17 +12,46 @@ var log = logging.Logger("superadmin")
 const topicName = "/PureGamer/superadmin"
 
 type SuperAdmin struct {
-	n   *model.Node
-	sub *pubsub.Subscription
-	top *pubsub.Topic
+	n         *model.Node
+	sub       *pubsub.Subscription
+	top       *pubsub.Topic
+	digestSub *pubsub.Subscription
+	digestTop *pubsub.Topic
+	keysSub   *pubsub.Subscription
+	keysTop   *pubsub.Topic
+	// proposalsTop carries the proposals waiting for co-signatures.
+	proposalsTop *pubsub.Topic
+	validator    *validator
+	version      *version
+	keys         *keyring
+
+	// lock serializes applying configs and guards latest and digest.
+	lock sync.Mutex
+	// latest is the signed config applied last, as it was received.
+	latest []byte
+	digest model.ConfigDigest
+	// syncing is held while the node syncs its config from peers.
+	syncing sync.Mutex
+	limiter *syncLimiter
+
+	proposalLock sync.Mutex
+	proposals    map[string]*pending
 }
 
 func NewSuperAdmin(node *model.Node) (*SuperAdmin, error) {
-	validator, err := newValidator(node.FixedConfig)
+	version, err := loadVersion(node.CTX, node)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := loadKeyring(node.CTX, node)
 	if err != nil {
 		return nil, err
 	}
-	err = node.PubSub.RegisterTopicValidator(topicName, validator)
+	validator, err := newValidator(node.FixedConfig, keys, version)
+	if err != nil {
+		return nil, err
+	}
+	err = node.PubSub.RegisterTopicValidator(topicName, validator.validate)
 	if err != nil {
 		return nil, err
 	}
@@ -37,9 +67,64 @@ func NewSuperAdmin(node *model.Node) (*SuperAdmin, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &SuperAdmin{
-		n:   node,
-		sub: subscription,
-		top: topic,
-	}, nil
+
+	err = node.PubSub.RegisterTopicValidator(digestTopicName, validateDigest)
+	if err != nil {
+		return nil, err
+	}
+	digestTopic, err := node.PubSub.Join(digestTopicName)
+	if err != nil {
+		return nil, err
+	}
+	digestSubscription, err := digestTopic.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = node.PubSub.RegisterTopicValidator(keysTopicName, keys.validate)
+	if err != nil {
+		return nil, err
+	}
+	keysTopic, err := node.PubSub.Join(keysTopicName)
+	if err != nil {
+		return nil, err
+	}
+	keysSubscription, err := keysTopic.Subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	su := &SuperAdmin{
+		n:         node,
+		sub:       subscription,
+		top:       topic,
+		digestSub: digestSubscription,
+		digestTop: digestTopic,
+		keysSub:   keysSubscription,
+		keysTop:   keysTopic,
+		validator: validator,
+		version:   version,
+		keys:      keys,
+		limiter:   newSyncLimiter(),
+		proposals: make(map[string]*pending),
+	}
+	err = su.loadLatest(node.CTX)
+	if err != nil {
+		log.Warnf("Could not load the last signed config: %s", err)
+	}
+	node.Host.SetStreamHandler(syncProtocol, su.syncHandler)
+
+	err = node.PubSub.RegisterTopicValidator(proposalsTopicName, su.validateProposal)
+	if err != nil {
+		return nil, err
+	}
+	su.proposalsTop, err = node.PubSub.Join(proposalsTopicName)
+	if err != nil {
+		return nil, err
+	}
+	_, err = su.proposalsTop.Relay()
+	if err != nil {
+		return nil, err
+	}
+	return su, nil
 }
@@ -0,0 +1,427 @@
+package superadmin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/ipfs/go-datastore"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/protocol"
+	"github.com/vmihailenco/msgpack/v5"
+	"io"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// syncProtocol serves the signed config a node applied last to peers
+	// that have an older one.
+	syncProtocol    = protocol.ID("/PureGamer/config/sync")
+	digestTopicName = "/PureGamer/superadmin/digest"
+	// announceInterval is how often nodes announce the digest of their config.
+	announceInterval = time.Minute
+	// catchUpDelay leaves a starting node time to connect to its peers
+	// before it asks them for their config.
+	catchUpDelay = 10 * time.Second
+	syncTimeout  = 10 * time.Second
+	// syncPeers is how many peers a starting node asks for their config.
+	syncPeers = 8
+	// maxConfigSize bounds the signed configs read from peers.
+	maxConfigSize = 1 << 20
+	// syncInterval is how often at most a node syncs from the same peer.
+	syncInterval = announceInterval
+	// maxSyncBackoff bounds how long a node stops syncing from a peer whose
+	// answers were of no use.
+	maxSyncBackoff = time.Hour
+)
+
+var latestKey = datastore.NewKey("/superadmin/config")
+
+func digestOf(signedConfig model.SignedConfig, config model.Config) model.ConfigDigest {
+	hash := sha256.Sum256(signedConfig.Config)
+	return model.ConfigDigest{Version: config.Version, Hash: hash[:]}
+}
+
+func validateDigest(ctx context.Context, p peer.ID, msg *pubsub.Message) bool {
+	if msg.Signature == nil {
+		return false
+	}
+	var digest model.ConfigDigest
+	return msgpack.Unmarshal(msg.GetData(), &digest) == nil
+}
+
+// remember keeps data, the signed config just applied, to serve it to peers.
+// su.lock must be held.
+func (su *SuperAdmin) remember(ctx context.Context, data []byte, signedConfig model.SignedConfig, config model.Config) error {
+	su.latest = data
+	su.digest = digestOf(signedConfig, config)
+	if !legacySigned(signedConfig) {
+		su.validator.modern.Store(true)
+	}
+	if su.n.Store == nil {
+		return nil
+	}
+	return su.n.Store.Put(ctx, latestKey, data)
+}
+
+// loadLatest reads the signed config applied before the node restarted.
+func (su *SuperAdmin) loadLatest(ctx context.Context) error {
+	if su.n.Store == nil {
+		return nil
+	}
+	data, err := su.n.Store.Get(ctx, latestKey)
+	if err == datastore.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var signedConfig model.SignedConfig
+	err = msgpack.Unmarshal(data, &signedConfig)
+	if err != nil {
+		return err
+	}
+	config, err := su.validator.open(signedConfig)
+	if err != nil {
+		return err
+	}
+	su.version.seen(signedConfig.Config)
+	su.lock.Lock()
+	defer su.lock.Unlock()
+	su.latest = data
+	su.digest = digestOf(signedConfig, config)
+	if !legacySigned(signedConfig) {
+		su.validator.modern.Store(true)
+	}
+	return nil
+}
+
+// syncHandler answers a ConfigSyncRequest with the key rotations the peer
+// misses, and the signed config of the node when it is newer than the one of
+// the peer. The stream is closed without an answer when the peer is not
+// behind.
+func (su *SuperAdmin) syncHandler(s network.Stream) {
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(syncTimeout))
+	var request model.ConfigSyncRequest
+	err := msgpack.NewDecoder(io.LimitReader(s, maxConfigSize)).Decode(&request)
+	if err != nil {
+		log.Warn(err)
+		s.Reset()
+		return
+	}
+	response := model.ConfigSyncResponse{Rotations: su.keys.since(request.KeySeq)}
+	su.lock.Lock()
+	if su.latest != nil && su.digest.Version > request.Version {
+		response.Config = su.latest
+	}
+	su.lock.Unlock()
+	if len(response.Rotations) == 0 && response.Config == nil {
+		return
+	}
+	data, err := msgpack.Marshal(response)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	_, err = s.Write(data)
+	if err != nil {
+		log.Warn(err)
+	}
+}
+
+// fetch asks p for what the node misses. The response is empty when p is not
+// ahead of the node.
+func (su *SuperAdmin) fetch(ctx context.Context, p peer.ID) (model.ConfigSyncResponse, error) {
+	var response model.ConfigSyncResponse
+	ctx, cancel := context.WithTimeout(ctx, syncTimeout)
+	defer cancel()
+	s, err := su.n.Host.NewStream(ctx, p, syncProtocol)
+	if err != nil {
+		return response, err
+	}
+	defer s.Close()
+	s.SetDeadline(time.Now().Add(syncTimeout))
+	request := model.ConfigSyncRequest{
+		Version: su.version.current(),
+		KeySeq:  su.keys.current(),
+	}
+	err = msgpack.NewEncoder(s).Encode(request)
+	if err != nil {
+		return response, err
+	}
+	err = s.CloseWrite()
+	if err != nil {
+		return response, err
+	}
+	data, err := io.ReadAll(io.LimitReader(s, maxConfigSize+1))
+	if err != nil {
+		return response, err
+	}
+	if len(data) == 0 {
+		return response, nil
+	}
+	if len(data) > maxConfigSize {
+		return response, fmt.Errorf("config of %s is larger than %d bytes", p, maxConfigSize)
+	}
+	err = msgpack.Unmarshal(data, &response)
+	return response, err
+}
+
+// syncFrom asks peers for the key rotations and signed config they have and
+// the node misses. Rotations are applied as they come, so that configs
+// signed by the keys they add can be verified, and the newest config is
+// applied at the end. Nothing is done when a sync is already running.
+func (su *SuperAdmin) syncFrom(ctx context.Context, peers []peer.ID) {
+	if !su.syncing.TryLock() {
+		return
+	}
+	defer su.syncing.Unlock()
+	su.syncLocked(ctx, peers, false)
+}
+
+// syncAnnounced is syncFrom for peers that announced being ahead, each synced
+// from as often as the limiter allows. Peers are only held off once the sync
+// runs.
+func (su *SuperAdmin) syncAnnounced(ctx context.Context, peers []peer.ID) {
+	if !su.syncing.TryLock() {
+		return
+	}
+	defer su.syncing.Unlock()
+	peers = slices.DeleteFunc(peers, func(p peer.ID) bool { return !su.limiter.allow(p) })
+	su.syncLocked(ctx, peers, true)
+}
+
+// syncLocked syncs from peers, holding su.syncing. When limited, the limiter
+// learns which peers were of use.
+func (su *SuperAdmin) syncLocked(ctx context.Context, peers []peer.ID, limited bool) {
+	var best []byte
+	var bestSigned model.SignedConfig
+	var bestConfig model.Config
+	version := su.version.current()
+	for _, p := range peers {
+		data, signedConfig, config, useful := su.syncPeer(ctx, p, version)
+		if limited {
+			su.limiter.done(p, useful)
+		}
+		if data == nil {
+			continue
+		}
+		best, bestSigned, bestConfig = data, signedConfig, config
+		version = config.Version
+	}
+	if best == nil {
+		return
+	}
+	log.Infof("Synced config %d from peers", bestConfig.Version)
+	err := su.handleConfig(best, bestSigned, bestConfig)
+	if err != nil && !errors.Is(err, errNotNewer) {
+		log.Error(err)
+	}
+}
+
+// syncPeer fetches what the node misses from p and applies the key rotations.
+// It returns the signed config of p when it verifies and is newer than
+// version, and tells whether p sent anything of use.
+func (su *SuperAdmin) syncPeer(ctx context.Context, p peer.ID, version uint64) (data []byte, signedConfig model.SignedConfig, config model.Config, useful bool) {
+	response, err := su.fetch(ctx, p)
+	if err != nil {
+		log.Warnf("Could not sync config from %s: %s", p, err)
+		return
+	}
+	for _, rotation := range response.Rotations {
+		err = su.keys.rotate(su.n.CTX, rotation)
+		if errors.Is(err, errNotNewer) {
+			continue
+		}
+		if err != nil {
+			log.Warnf("Could not sync key rotations from %s: %s", p, err)
+			break
+		}
+		useful = true
+	}
+	if response.Config == nil {
+		return
+	}
+	err = msgpack.Unmarshal(response.Config, &signedConfig)
+	if err != nil {
+		log.Warnf("Could not sync config from %s: %s", p, err)
+		return
+	}
+	config, err = su.validator.open(signedConfig)
+	if err != nil {
+		log.Warnf("Rejected config from %s: %s", p, err)
+		return
+	}
+	if config.Version <= version {
+		return
+	}
+	return response.Config, signedConfig, config, true
+}
+
+// sources returns the peers msg may be synced from: its publisher, and the
+// peer it was received from.
+func sources(msg *pubsub.Message) []peer.ID {
+	peers := []peer.ID{msg.GetFrom()}
+	if msg.ReceivedFrom != msg.GetFrom() {
+		peers = append(peers, msg.ReceivedFrom)
+	}
+	return peers
+}
+
+// catchUp asks some connected peers for their config once the node had time
+// to connect, for the configs broadcast while it was away.
+func (su *SuperAdmin) catchUp(ctx context.Context) {
+	select {
+	case <-time.After(catchUpDelay):
+	case <-ctx.Done():
+		return
+	}
+	var peers []peer.ID
+	for _, p := range su.n.Host.Network().Peers() {
+		if _, ok := su.n.BootstrapNodesCheck[p]; ok {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > syncPeers {
+		peers = peers[:syncPeers]
+	}
+	su.syncFrom(ctx, peers)
+}
+
+// announce publishes the digest of the config of the node every
+// announceInterval until ctx is done.
+func (su *SuperAdmin) announce(ctx context.Context) {
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		su.lock.Lock()
+		latest, digest := su.latest, su.digest
+		su.lock.Unlock()
+		digest.KeySeq = su.keys.current()
+		if latest == nil && digest.KeySeq == 0 {
+			continue
+		}
+		data, err := msgpack.Marshal(digest)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		err = su.digestTop.Publish(ctx, data)
+		if err != nil {
+			log.Warn(err)
+		}
+	}
+}
+
+// handleDigests syncs from the peers announcing a newer config or key
+// rotation, as often as the limiter allows, and warns about peers that applied a different config of the
+// same version.
+func (su *SuperAdmin) handleDigests(ctx context.Context) {
+	for {
+		msg, err := su.digestSub.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Error(err)
+			continue
+		}
+		from := msg.GetFrom()
+		if from == su.n.Host.ID() {
+			continue
+		}
+		var digest model.ConfigDigest
+		err = msgpack.Unmarshal(msg.GetData(), &digest)
+		if err != nil {
+			log.Warn(err)
+			continue
+		}
+
+		su.lock.Lock()
+		own := su.digest
+		su.lock.Unlock()
+		version, keySeq := su.version.current(), su.keys.current()
+		switch {
+		case digest.Version > version || digest.KeySeq > keySeq:
+			log.Infof("%s has config %d and key rotation %d, this node has %d and %d", from, digest.Version, digest.KeySeq, version, keySeq)
+			go su.syncAnnounced(ctx, sources(msg))
+		case digest.Version == own.Version && !bytes.Equal(digest.Hash, own.Hash):
+			log.Warnf("%s applied another config %d than this node", from, digest.Version)
+		}
+	}
+}
+
+// syncLimiter spaces the syncs from each announcing peer, and backs off from
+// the peers whose answers were empty or did not verify.
+type syncLimiter struct {
+	lock  sync.Mutex
+	peers map[peer.ID]*peerSync
+}
+
+type peerSync struct {
+	// next is when the peer may be synced from again.
+	next    time.Time
+	backoff time.Duration
+}
+
+func newSyncLimiter() *syncLimiter {
+	return &syncLimiter{peers: make(map[peer.ID]*peerSync)}
+}
+
+// allow tells whether p may be synced from now, and if so holds it off for
+// syncInterval.
+func (l *syncLimiter) allow(p peer.ID) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for id, state := range l.peers {
+		if now.Sub(state.next) > maxSyncBackoff {
+			delete(l.peers, id)
+		}
+	}
+	state, ok := l.peers[p]
+	if !ok {
+		state = &peerSync{}
+		l.peers[p] = state
+	}
+	if now.Before(state.next) {
+		return false
+	}
+	state.next = now.Add(syncInterval)
+	return true
+}
+
+// done records whether the sync from p was of use. Each sync of no use in a
+// row doubles the time until p is synced from again.
+func (l *syncLimiter) done(p peer.ID, useful bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	state, ok := l.peers[p]
+	if !ok {
+		return
+	}
+	if useful {
+		state.backoff = 0
+		return
+	}
+	state.backoff = min(max(2*state.backoff, syncInterval), maxSyncBackoff)
+	state.next = time.Now().Add(state.backoff)
+	log.Infof("Not syncing from %s for %s", p, state.backoff)
+}
@@ -0,0 +1,42 @@
+package superadmin
+
+import (
+	"context"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"testing"
+	"time"
+)
+
+func TestSyncAnnouncedKeepsSlotWhenBusy(t *testing.T) {
+	su, _ := newTestAdmin(t, time.Time{})
+	p := peer.ID("announcer")
+
+	// another sync is running, this one is skipped without a fetch
+	su.syncing.Lock()
+	su.syncAnnounced(context.Background(), []peer.ID{p})
+	su.syncing.Unlock()
+
+	if !su.limiter.allow(p) {
+		t.Error("skipped sync held the peer off")
+	}
+}
+
+func TestSyncLimiterBacksOff(t *testing.T) {
+	l := newSyncLimiter()
+	p := peer.ID("announcer")
+	if !l.allow(p) {
+		t.Fatal("first sync not allowed")
+	}
+	if l.allow(p) {
+		t.Error("second sync allowed within syncInterval")
+	}
+	l.done(p, false)
+	l.done(p, false)
+	if backoff := l.peers[p].backoff; backoff != 2*syncInterval {
+		t.Errorf("backoff %s after two useless syncs, want %s", backoff, 2*syncInterval)
+	}
+	l.done(p, true)
+	if backoff := l.peers[p].backoff; backoff != 0 {
+		t.Errorf("backoff %s after a useful sync, want none", backoff)
+	}
+}
@@ -2,32 +2,122 @@ package superadmin
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/GlazeLab/PureGamer/src/model"
 	"github.com/GlazeLab/PureGamer/src/utils"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/vmihailenco/msgpack/v5"
+	"slices"
+	"sync/atomic"
+	"time"
 )
 
-func newValidator(config *model.FixedConfig) (interface{}, error) {
-	pubKey, err := utils.DecodePublic(config.SuperAdminPubKey)
-	if err != nil {
-		return nil, err
-	}
-	return func(ctx context.Context, p peer.ID, msg *pubsub.Message) bool {
-		var signedConfig model.SignedConfig
-		err := msgpack.Unmarshal(msg.GetData(), &signedConfig)
-		if err != nil {
-			log.Error(err)
-			return false
-		}
-		log.Info("Received config from superadmin")
-		sign := signedConfig.Sign
-		configBytes, err := msgpack.Marshal(signedConfig.Config)
+// clockSkew is how far in the future a config may be dated.
+const clockSkew = 5 * time.Minute
+
+var (
+	errBadSignature = errors.New("not signed by an admin key")
+	errLegacySign   = errors.New("configs signed over MD5 are no longer accepted")
+)
+
+// validator accepts configs signed by enough admin keys that are newer than
+// the one applied by the node.
+type validator struct {
+	keys    *keyring
+	version *version
+	// legacyUntil ends the migration window of legacy signatures, zero when
+	// it ends with the first config signed otherwise.
+	legacyUntil time.Time
+	// modern is set once a config not signed over MD5 is applied, after
+	// which legacy signatures are rejected.
+	modern atomic.Bool
+}
+
+func newValidator(config *model.FixedConfig, keys *keyring, version *version) (*validator, error) {
+	v := &validator{keys: keys, version: version}
+	if config.LegacySignaturesUntil != "" {
+		until, err := time.Parse(time.RFC3339, config.LegacySignaturesUntil)
 		if err != nil {
-			log.Error(err)
-			return false
+			return nil, err
 		}
-		return utils.Verify(configBytes, sign, pubKey)
-	}, nil
+		v.legacyUntil = until
+	}
+	return v, nil
+}
+
+// legacy tells if configs signed over MD5 are still accepted.
+func (v *validator) legacy() bool {
+	if v.modern.Load() {
+		return false
+	}
+	return v.legacyUntil.IsZero() || time.Now().Before(v.legacyUntil)
+}
+
+// legacySigned tells if signedConfig carries a signature over MD5.
+func legacySigned(signedConfig model.SignedConfig) bool {
+	return signedConfig.Sign != "" && signedConfig.Algorithm == utils.LegacyAlgorithm
+}
+
+// fresh tells if config, opened from signedConfig, may be applied. Configs
+// of older versions carry no version, so while legacy ones are accepted they
+// are applied when they differ from the applied one.
+func (v *validator) fresh(signedConfig model.SignedConfig, config model.Config) bool {
+	return v.version.fresh(config, signedConfig.Config, legacySigned(signedConfig) && v.legacy())
+}
+
+// open verifies that signedConfig is signed by enough admin keys, over the
+// bytes that were signed, and only then decodes its config. Signatures over
+// MD5 only count in Sign, and while legacy ones are accepted. Configs dated
+// in the future are rejected.
+func (v *validator) open(signedConfig model.SignedConfig) (model.Config, error) {
+	var config model.Config
+	if legacySigned(signedConfig) && !v.legacy() {
+		return config, errLegacySign
+	}
+	err := modernOnly(signedConfig.Signatures)
+	if err != nil {
+		return config, err
+	}
+	signatures := signedConfig.Signatures
+	if signedConfig.Sign != "" {
+		signatures = append(slices.Clip(signatures), model.Signature{
+			Algorithm: signedConfig.Algorithm,
+			Sign:      signedConfig.Sign,
+		})
+	}
+	err = v.keys.approved(signedConfig.Config, signatures)
+	if err != nil {
+		return config, err
+	}
+	err = msgpack.Unmarshal(signedConfig.Config, &config)
+	if err != nil {
+		return config, err
+	}
+	issued := time.UnixMilli(config.IssuedAt)
+	if issued.After(time.Now().Add(clockSkew)) {
+		return config, fmt.Errorf("config %d is dated %s", config.Version, issued)
+	}
+	return config, nil
+}
+
+func (v *validator) validate(ctx context.Context, p peer.ID, msg *pubsub.Message) bool {
+	var signedConfig model.SignedConfig
+	err := msgpack.Unmarshal(msg.GetData(), &signedConfig)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	log.Info("Received config from superadmin")
+	config, err := v.open(signedConfig)
+	if err != nil {
+		log.Warnf("Rejected config from %s: %s", msg.GetFrom(), err)
+		return false
+	}
+	if !v.fresh(signedConfig, config) {
+		log.Warnf("Rejected config %d issued at %s, already applied %d", config.Version, time.UnixMilli(config.IssuedAt), v.version.current())
+		return false
+	}
+	return true
 }
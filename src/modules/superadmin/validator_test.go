@@ -0,0 +1,184 @@
+package superadmin
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/GlazeLab/PureGamer/src/utils"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/vmihailenco/msgpack/v5"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// baselineGame, baselineConfig and baselineSignedConfig are the messages of
+// the versions before configs were versioned, signed over MD5.
+type baselineGame struct {
+	ID         string `msgpack:"id"`
+	Protocol   string `msgpack:"protocol"`
+	Host       string `msgpack:"host"`
+	Port       uint64 `msgpack:"port"`
+	ListenPort uint64 `msgpack:"listen_port"`
+}
+
+type baselineConfig struct {
+	Games []baselineGame `msgpack:"games"`
+}
+
+type baselineSignedConfig struct {
+	Config baselineConfig `msgpack:"config"`
+	Sign   string         `msgpack:"sign"`
+}
+
+func newTestAdmin(t *testing.T, legacyUntil time.Time) (*SuperAdmin, *ecdsa.PrivateKey) {
+	t.Helper()
+	privKey, pubKey, err := utils.GenerateKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pem, err := utils.EncodePublic(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &model.Node{
+		CTX:    context.Background(),
+		Config: &model.Config{},
+		FixedConfig: &model.FixedConfig{
+			SuperAdminPubKey:      pem,
+			ConfigPath:            filepath.Join(t.TempDir(), "dynamic.json"),
+			LegacySignaturesUntil: legacyUntil.Format(time.RFC3339),
+		},
+	}
+	version, err := loadVersion(n.CTX, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := loadKeyring(n.CTX, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator, err := newValidator(n.FixedConfig, keys, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SuperAdmin{
+		n:         n,
+		validator: validator,
+		version:   version,
+		keys:      keys,
+		limiter:   newSyncLimiter(),
+		proposals: make(map[string]*pending),
+	}, privKey
+}
+
+func baselineMessage(t *testing.T, privKey *ecdsa.PrivateKey, gameId string) []byte {
+	t.Helper()
+	config := baselineConfig{Games: []baselineGame{{ID: gameId, Protocol: "TCP", Host: "127.0.0.1", Port: 25565, ListenPort: 25565}}}
+	payload, err := msgpack.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign, err := utils.Sign(payload, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := msgpack.Marshal(baselineSignedConfig{Config: config, Sign: sign})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func modernMessage(t *testing.T, privKey *ecdsa.PrivateKey, config model.Config) []byte {
+	t.Helper()
+	payload, err := msgpack.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proposal := model.Proposal{Kind: model.ProposeConfig, Payload: payload}
+	err = signProposal(&proposal, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := msgpack.Marshal(model.SignedConfig{Config: payload, Signatures: proposal.Signatures})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// deliver passes data through the validator and, when accepted, applies it
+// as Handle does. It tells whether the config was applied.
+func deliver(t *testing.T, su *SuperAdmin, data []byte) bool {
+	t.Helper()
+	msg := &pubsub.Message{Message: &pb.Message{Data: data}}
+	if !su.validator.validate(context.Background(), "", msg) {
+		return false
+	}
+	var signedConfig model.SignedConfig
+	err := msgpack.Unmarshal(data, &signedConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config model.Config
+	err = msgpack.Unmarshal(signedConfig.Config, &config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = su.handleConfig(data, signedConfig, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return true
+}
+
+func appliedGame(su *SuperAdmin) string {
+	if len(su.n.Config.Games) == 0 {
+		return ""
+	}
+	return su.n.Config.Games[0].ID
+}
+
+func TestLegacyConfigDuringWindow(t *testing.T) {
+	su, privKey := newTestAdmin(t, time.Now().Add(time.Hour))
+
+	if !deliver(t, su, baselineMessage(t, privKey, "first")) {
+		t.Fatal("baseline config rejected during the window")
+	}
+	if got := appliedGame(su); got != "first" {
+		t.Fatalf("applied game %q, want first", got)
+	}
+	if deliver(t, su, baselineMessage(t, privKey, "first")) {
+		t.Error("same baseline config applied twice")
+	}
+	if !deliver(t, su, baselineMessage(t, privKey, "second")) {
+		t.Fatal("changed baseline config rejected during the window")
+	}
+	if got := appliedGame(su); got != "second" {
+		t.Fatalf("applied game %q, want second", got)
+	}
+
+	// the first modern config closes the window
+	if !deliver(t, su, modernMessage(t, privKey, model.Config{Version: 1, Games: []model.Game{{ID: "modern"}}})) {
+		t.Fatal("modern config rejected")
+	}
+	if deliver(t, su, baselineMessage(t, privKey, "third")) {
+		t.Error("baseline config applied after a modern one")
+	}
+	if got := appliedGame(su); got != "modern" {
+		t.Errorf("applied game %q, want modern", got)
+	}
+}
+
+func TestLegacyConfigAfterWindow(t *testing.T) {
+	su, privKey := newTestAdmin(t, time.Now().Add(-time.Hour))
+
+	if deliver(t, su, baselineMessage(t, privKey, "first")) {
+		t.Error("baseline config applied after the window")
+	}
+	if got := appliedGame(su); got != "" {
+		t.Errorf("applied game %q, want none", got)
+	}
+}
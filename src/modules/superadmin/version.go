@@ -0,0 +1,101 @@
+package superadmin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/GlazeLab/PureGamer/src/model"
+	"github.com/ipfs/go-datastore"
+	dbstore "github.com/ipfs/go-ds-leveldb"
+	"sync"
+)
+
+var versionKey = datastore.NewKey("/superadmin/version")
+
+var errNotNewer = errors.New("config is not newer than the applied one")
+
+// version tracks the highest config version applied by the node, so that
+// recorded configs cannot be broadcast again to roll the network back.
+type version struct {
+	lock    sync.Mutex
+	store   *dbstore.Datastore
+	applied uint64
+	// hash is the SHA-256 of the payload of the config applied last, to tell
+	// the unversioned configs of older versions apart.
+	hash []byte
+}
+
+// loadVersion reads the applied version from the store of the node, or from
+// its config file when that one is higher.
+func loadVersion(ctx context.Context, n *model.Node) (*version, error) {
+	v := &version{store: n.Store}
+	if n.Config != nil {
+		v.applied = n.Config.Version
+	}
+	if n.Store == nil {
+		return v, nil
+	}
+	data, err := n.Store.Get(ctx, versionKey)
+	if err == datastore.ErrNotFound {
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != 8 {
+		return nil, fmt.Errorf("malformed config version in store: %x", data)
+	}
+	v.applied = max(v.applied, binary.BigEndian.Uint64(data))
+	return v, nil
+}
+
+func (v *version) current() uint64 {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.applied
+}
+
+func (v *version) newer(config model.Config) bool {
+	return config.Version > v.current()
+}
+
+// fresh tells if config, encoded as payload, may be applied: when it is
+// newer, or, for a legacy config, when it has no version, as configs sent by
+// older versions do, and differs from the applied one.
+func (v *version) fresh(config model.Config, payload []byte, legacy bool) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if config.Version > v.applied {
+		return true
+	}
+	hash := sha256.Sum256(payload)
+	return legacy && config.Version == 0 && !bytes.Equal(hash[:], v.hash)
+}
+
+// seen records payload as the one of the config applied last.
+func (v *version) seen(payload []byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	hash := sha256.Sum256(payload)
+	v.hash = hash[:]
+}
+
+// apply records config, encoded as payload, as applied. Only newer versions
+// are kept in the store, unversioned configs leave it as it is.
+func (v *version) apply(ctx context.Context, config model.Config, payload []byte) error {
+	v.seen(payload)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if config.Version <= v.applied {
+		return nil
+	}
+	v.applied = config.Version
+	if v.store == nil {
+		return nil
+	}
+	data := binary.BigEndian.AppendUint64(nil, config.Version)
+	return v.store.Put(ctx, versionKey, data)
+}
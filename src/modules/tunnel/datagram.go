@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	pool "github.com/libp2p/go-buffer-pool"
+	"io"
+	"sync"
+)
+
+const seqSize = 8
+
+// MaxDatagramSize is the largest datagram WriteDatagram can carry.
+const MaxDatagramSize = MaxFrameSize - seqSize
+
+var ErrShortDatagram = errors.New("datagram frame too short")
+
+// WriteDatagram writes a UDP datagram with its sequence number as one frame.
+// The sequence number lets a receiver drop the copies sent over other paths.
+func WriteDatagram(w io.Writer, seq uint64, b []byte) error {
+	if len(b) > MaxDatagramSize {
+		return ErrFrameTooLarge
+	}
+	buf := pool.Get(seqSize + len(b))
+	defer pool.Put(buf)
+	binary.BigEndian.PutUint64(buf, seq)
+	copy(buf[seqSize:], b)
+	return WriteFrame(w, buf)
+}
+
+// ReadDatagram reads a frame written by WriteDatagram into buf and returns
+// the sequence number and where the datagram is in buf.
+func ReadDatagram(r io.Reader, buf []byte) (uint64, []byte, error) {
+	size, err := ReadFrame(r, buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size < seqSize {
+		return 0, nil, ErrShortDatagram
+	}
+	return binary.BigEndian.Uint64(buf), buf[seqSize:size], nil
+}
+
+const windowSize = 1024
+
+// Window remembers the recently received sequence numbers so that every
+// datagram is delivered once, however many paths it came over. Datagrams
+// older than the window are dropped as well.
+type Window struct {
+	lock sync.Mutex
+	top  uint64
+	seen [windowSize / 64]uint64
+}
+
+// Fresh reports whether seq has not been received yet and records it.
+func (w *Window) Fresh(seq uint64) bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if seq > w.top {
+		shift := seq - w.top
+		if shift >= windowSize {
+			w.seen = [windowSize / 64]uint64{}
+		} else {
+			for i := w.top + 1; i <= seq; i++ {
+				w.clear(i)
+			}
+		}
+		w.top = seq
+		w.set(seq)
+		return true
+	}
+	if w.top-seq >= windowSize || w.has(seq) {
+		return false
+	}
+	w.set(seq)
+	return true
+}
+
+func (w *Window) set(seq uint64) {
+	w.seen[(seq%windowSize)/64] |= 1 << (seq % 64)
+}
+
+func (w *Window) clear(seq uint64) {
+	w.seen[(seq%windowSize)/64] &^= 1 << (seq % 64)
+}
+
+func (w *Window) has(seq uint64) bool {
+	return w.seen[(seq%windowSize)/64]&(1<<(seq%64)) != 0
+}
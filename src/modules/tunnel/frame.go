@@ -0,0 +1,46 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	pool "github.com/libp2p/go-buffer-pool"
+	"io"
+)
+
+// MaxFrameSize is the largest payload a single frame can carry.
+const MaxFrameSize = 65535
+
+const headerSize = 2
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// WriteFrame writes b to w prefixed with its length, in a single write so
+// that a datagram is never interleaved with another one.
+func WriteFrame(w io.Writer, b []byte) error {
+	if len(b) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	buf := pool.Get(headerSize + len(b))
+	defer pool.Put(buf)
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[headerSize:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadFrame reads one frame from r into buf and returns the payload length.
+// buf must be able to hold MaxFrameSize bytes.
+func ReadFrame(r io.Reader, buf []byte) (int, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		return 0, ErrFrameTooLarge
+	}
+	if _, err := io.ReadFull(r, buf[:size]); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
@@ -0,0 +1,383 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	frameData byte = iota + 1
+	frameAck
+	frameClose
+	frameHello
+)
+
+const (
+	// maxChunk is the largest payload of a data frame.
+	maxChunk = MaxFrameSize - 1 - seqSize
+	// maxPending is how many bytes may wait for an acknowledgement, or for
+	// the application to read them, before the writer is held back.
+	maxPending = 4 << 20
+	// ackEvery is how many received bytes trigger an immediate acknowledgement.
+	ackEvery = 32 << 10
+	// ackInterval is how often received bytes are acknowledged otherwise.
+	ackInterval = 100 * time.Millisecond
+)
+
+var (
+	ErrResumeFailed = errors.New("session cannot be resumed, data was lost")
+	ErrConnClosed   = errors.New("session is closed")
+)
+
+// Conn is one end of a session between the entry and the exit node that
+// outlives the streams carrying it. Written bytes are kept until the other
+// end acknowledges them, so that when a stream breaks or a better route is
+// found, the session resumes on a new stream and the game server keeps its
+// connection.
+type Conn struct {
+	resumeTimeout time.Duration
+
+	// writeLock orders the frames written to the streams.
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	stream  io.ReadWriteCloser
+	acked   uint64
+	pending []byte
+
+	received uint64
+	ackSent  uint64
+	readBuf  bytes.Buffer
+
+	peerClosed bool
+	closed     bool
+	resume     *time.Timer
+
+	broken chan struct{}
+	done   chan struct{}
+}
+
+// NewConn returns a session with no stream yet. Once it has no stream for
+// resumeTimeout, it is closed.
+func NewConn(resumeTimeout time.Duration) *Conn {
+	c := &Conn{
+		resumeTimeout: resumeTimeout,
+		broken:        make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	c.resume = time.AfterFunc(resumeTimeout, c.expire)
+	go c.ackLoop()
+	return c
+}
+
+// Broken signals when the current stream failed and another is needed.
+func (c *Conn) Broken() <-chan struct{} {
+	return c.broken
+}
+
+// Done is closed with the session.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Resume moves the session onto s. Both ends tell each other how much they
+// received, and everything the other end is missing is sent again. The
+// returned channel is closed when s no longer carries the session.
+func (c *Conn) Resume(s io.ReadWriteCloser) (<-chan struct{}, error) {
+	c.lock.Lock()
+	received := c.received
+	c.lock.Unlock()
+
+	hello := make([]byte, 1+seqSize)
+	hello[0] = frameHello
+	binary.BigEndian.PutUint64(hello[1:], received)
+	err := WriteFrame(s, hello)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, MaxFrameSize)
+	size, err := ReadFrame(s, buf)
+	if err != nil {
+		return nil, err
+	}
+	if size != 1+seqSize || buf[0] != frameHello {
+		return nil, errors.New("session handshake is malformed")
+	}
+	peerReceived := binary.BigEndian.Uint64(buf[1:])
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil, ErrConnClosed
+	}
+	written := c.acked + uint64(len(c.pending))
+	if peerReceived < c.acked || peerReceived > written {
+		c.lock.Unlock()
+		c.fail()
+		return nil, ErrResumeFailed
+	}
+	c.pending = c.pending[peerReceived-c.acked:]
+	c.acked = peerReceived
+	c.ackSent = received
+	c.cond.Broadcast()
+	old := c.stream
+	c.stream = s
+	c.resume.Stop()
+	// drain a failure of the old stream, it is replaced now
+	select {
+	case <-c.broken:
+	default:
+	}
+	retransmit := append([]byte{}, c.pending...)
+	offset := c.acked
+	c.lock.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	detached := make(chan struct{})
+	go c.readLoop(s, detached)
+
+	for len(retransmit) > 0 {
+		chunk := retransmit[:min(len(retransmit), maxChunk)]
+		err = writeData(s, offset, chunk)
+		if err != nil {
+			c.detach(s)
+			break
+		}
+		offset += uint64(len(chunk))
+		retransmit = retransmit[len(chunk):]
+	}
+	return detached, nil
+}
+
+func writeData(w io.Writer, offset uint64, chunk []byte) error {
+	frame := make([]byte, 1+seqSize+len(chunk))
+	frame[0] = frameData
+	binary.BigEndian.PutUint64(frame[1:], offset)
+	copy(frame[1+seqSize:], chunk)
+	return WriteFrame(w, frame)
+}
+
+func writeAck(w io.Writer, received uint64) error {
+	frame := make([]byte, 1+seqSize)
+	frame[0] = frameAck
+	binary.BigEndian.PutUint64(frame[1:], received)
+	return WriteFrame(w, frame)
+}
+
+// detach drops s if it still carries the session and waits for another one.
+func (c *Conn) detach(s io.ReadWriteCloser) {
+	c.lock.Lock()
+	current := c.stream == s
+	if current {
+		c.stream = nil
+		if !c.closed {
+			c.resume.Reset(c.resumeTimeout)
+		}
+	}
+	c.lock.Unlock()
+	s.Close()
+	if current {
+		select {
+		case c.broken <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *Conn) expire() {
+	c.lock.Lock()
+	detached := c.stream == nil && !c.closed
+	c.lock.Unlock()
+	if detached {
+		c.fail()
+	}
+}
+
+// fail closes the session without telling the other end.
+func (c *Conn) fail() {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.closed = true
+	stream := c.stream
+	c.stream = nil
+	c.resume.Stop()
+	c.cond.Broadcast()
+	c.lock.Unlock()
+	close(c.done)
+	if stream != nil {
+		stream.Close()
+	}
+}
+
+func (c *Conn) readLoop(s io.ReadWriteCloser, detached chan struct{}) {
+	defer close(detached)
+	buf := make([]byte, MaxFrameSize)
+	for {
+		size, err := ReadFrame(s, buf)
+		if err != nil || size == 0 {
+			c.detach(s)
+			return
+		}
+		switch buf[0] {
+		case frameData:
+			if size < 1+seqSize {
+				c.detach(s)
+				return
+			}
+			c.deliver(binary.BigEndian.Uint64(buf[1:]), buf[1+seqSize:size])
+		case frameAck:
+			if size < 1+seqSize {
+				c.detach(s)
+				return
+			}
+			c.ack(binary.BigEndian.Uint64(buf[1:]))
+		case frameClose:
+			c.lock.Lock()
+			c.peerClosed = true
+			c.cond.Broadcast()
+			c.lock.Unlock()
+		}
+	}
+}
+
+// deliver queues the part of a data frame that was not received yet.
+func (c *Conn) deliver(offset uint64, payload []byte) {
+	c.lock.Lock()
+	for c.readBuf.Len() >= maxPending && !c.closed {
+		c.cond.Wait()
+	}
+	end := offset + uint64(len(payload))
+	if offset > c.received || end <= c.received {
+		// a gap cannot happen on one stream, and what was resent after a
+		// resume may have arrived already
+		c.lock.Unlock()
+		return
+	}
+	c.readBuf.Write(payload[c.received-offset:])
+	c.received = end
+	c.cond.Broadcast()
+	ackNow := c.received-c.ackSent >= ackEvery
+	c.lock.Unlock()
+	if ackNow {
+		c.sendAck()
+	}
+}
+
+func (c *Conn) ack(received uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if received <= c.acked || received > c.acked+uint64(len(c.pending)) {
+		return
+	}
+	c.pending = c.pending[received-c.acked:]
+	c.acked = received
+	c.cond.Broadcast()
+}
+
+func (c *Conn) sendAck() {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.lock.Lock()
+	stream := c.stream
+	received := c.received
+	if stream == nil || received == c.ackSent {
+		c.lock.Unlock()
+		return
+	}
+	c.ackSent = received
+	c.lock.Unlock()
+	if writeAck(stream, received) != nil {
+		c.detach(stream)
+	}
+}
+
+func (c *Conn) ackLoop() {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sendAck()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// Read reads what the other end wrote, in order, whichever stream it came over.
+func (c *Conn) Read(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.readBuf.Len() == 0 {
+		if c.peerClosed || c.closed {
+			return 0, io.EOF
+		}
+		c.cond.Wait()
+	}
+	n, _ := c.readBuf.Read(p)
+	c.cond.Broadcast()
+	return n, nil
+}
+
+// Write sends p to the other end and keeps it until it is acknowledged.
+func (c *Conn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxChunk)]
+
+		c.lock.Lock()
+		for len(c.pending) >= maxPending && !c.closed {
+			c.cond.Wait()
+		}
+		c.lock.Unlock()
+
+		c.writeLock.Lock()
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			c.writeLock.Unlock()
+			return written, ErrConnClosed
+		}
+		offset := c.acked + uint64(len(c.pending))
+		c.pending = append(c.pending, chunk...)
+		stream := c.stream
+		c.lock.Unlock()
+		if stream != nil && writeData(stream, offset, chunk) != nil {
+			c.detach(stream)
+		}
+		c.writeLock.Unlock()
+
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close ends the session on both ends.
+func (c *Conn) Close() error {
+	c.writeLock.Lock()
+	c.lock.Lock()
+	stream := c.stream
+	closed := c.closed
+	c.lock.Unlock()
+	if !closed && stream != nil {
+		WriteFrame(stream, []byte{frameClose})
+	}
+	c.writeLock.Unlock()
+	c.fail()
+	return nil
+}
@@ -0,0 +1,147 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection. Unlike net.Pipe,
+// it buffers, so both ends can write their hello before reading.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		}
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+// resumeBoth resumes a onto sa and b onto sb at the same time, as both ends
+// of a session do.
+func resumeBoth(a *Conn, sa io.ReadWriteCloser, b *Conn, sb io.ReadWriteCloser) (error, error) {
+	errB := make(chan error, 1)
+	go func() {
+		_, err := b.Resume(sb)
+		errB <- err
+	}()
+	_, errA := a.Resume(sa)
+	return errA, <-errB
+}
+
+func TestResumeMidTransfer(t *testing.T) {
+	a, b := NewConn(time.Minute), NewConn(time.Minute)
+	defer a.Close()
+	defer b.Close()
+	sa, sb := tcpPair(t)
+	errA, errB := resumeBoth(a, sa, b, sb)
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+
+	sent := make([]byte, 1<<20)
+	_, err := rand.Read(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, err := a.Write(sent)
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	received := make([]byte, 0, len(sent))
+	buf := make([]byte, 32<<10)
+	for len(received) < len(sent)/4 {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, buf[:n]...)
+	}
+
+	// the route breaks under the transfer, the session moves to another one
+	sa.Close()
+	sb.Close()
+	sa, sb = tcpPair(t)
+	errA, errB = resumeBoth(a, sa, b, sb)
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+
+	rest := make([]byte, len(sent)-len(received))
+	_, err = io.ReadFull(b, rest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received = append(received, rest...)
+	if !bytes.Equal(received, sent) {
+		t.Fatalf("received %d bytes differing from the %d sent", len(received), len(sent))
+	}
+
+	// closing one end ends the session on the other
+	a.Close()
+	_, err = b.Read(buf)
+	if err != io.EOF {
+		t.Errorf("read %v after the other end closed, want EOF", err)
+	}
+}
+
+func TestResumeFailsWhenDataIsLost(t *testing.T) {
+	a, b := NewConn(time.Minute), NewConn(time.Minute)
+	defer a.Close()
+	defer b.Close()
+	sa, sb := tcpPair(t)
+	errA, errB := resumeBoth(a, sa, b, sb)
+	if errA != nil || errB != nil {
+		t.Fatal(errA, errB)
+	}
+	_, err := a.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(b, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an end that never wrote what b received cannot take the session over
+	c := NewConn(time.Minute)
+	sc, sb := tcpPair(t)
+	errC, _ := resumeBoth(c, sc, b, sb)
+	if !errors.Is(errC, ErrResumeFailed) {
+		t.Fatalf("resume error %v, want ErrResumeFailed", errC)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Error("session not closed after a failed resume")
+	}
+}
@@ -1,16 +1,31 @@
 package utils
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"hash"
 )
 
+// Signature algorithms of signed messages.
+const (
+	// LegacyAlgorithm is ECDSA over the MD5 of the message, as made by Sign.
+	LegacyAlgorithm = ""
+	ECDSASHA256     = "ecdsa-sha256"
+	Ed25519         = "ed25519"
+)
+
+var ErrNoPEM = errors.New("no PEM block found")
+
 // GenerateKeys EllipticCurve public and private keys
 func GenerateKeys() (*ecdsa.PrivateKey, *ecdsa.PublicKey, error) {
 	pubKeyCurve := elliptic.P256()
@@ -69,6 +84,96 @@ func DecodePublic(pemEncodedPub string) (*ecdsa.PublicKey, error) {
 	return publicKey, err
 }
 
+// DecodeSigner decodes an EC private key, or a PKCS #8 ECDSA or Ed25519 one.
+func DecodeSigner(pemEncodedPriv string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(pemEncodedPriv))
+	if block == nil {
+		return nil, ErrNoPEM
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key %T", key)
+}
+
+// DecodePublicKey decodes an ECDSA or Ed25519 public key.
+func DecodePublicKey(pemEncodedPub string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(pemEncodedPub))
+	if block == nil {
+		return nil, ErrNoPEM
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		return key, nil
+	case ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key %T", key)
+}
+
+// KeyID names a public key by the SHA-256 of its PKIX encoding.
+func KeyID(pubKey crypto.PublicKey) (string, error) {
+	encoded, err := x509.MarshalPKIXPublicKey(pubKey)
+	if err != nil {
+		return "", err
+	}
+	id := sha256.Sum256(encoded)
+	return hex.EncodeToString(id[:]), nil
+}
+
+// SignWith signs message with the algorithm matching privKey: ECDSA over
+// SHA-256, or Ed25519. It returns the algorithm along with the signature.
+func SignWith(message []byte, privKey crypto.Signer) (string, string, error) {
+	switch key := privKey.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256(message)
+		signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		if err != nil {
+			return "", "", err
+		}
+		return ECDSASHA256, hex.EncodeToString(signature), nil
+	case ed25519.PrivateKey:
+		return Ed25519, hex.EncodeToString(ed25519.Sign(key, message)), nil
+	}
+	return "", "", fmt.Errorf("unsupported private key %T", privKey)
+}
+
+// VerifyWith checks sign, made with algorithm, against pubKey.
+func VerifyWith(algorithm string, message []byte, sign string, pubKey crypto.PublicKey) bool {
+	signature, err := hex.DecodeString(sign)
+	if err != nil {
+		return false
+	}
+	switch key := pubKey.(type) {
+	case *ecdsa.PublicKey:
+		switch algorithm {
+		case LegacyAlgorithm:
+			return Verify(message, sign, key)
+		case ECDSASHA256:
+			digest := sha256.Sum256(message)
+			return ecdsa.VerifyASN1(key, digest[:], signature)
+		}
+	case ed25519.PublicKey:
+		return algorithm == Ed25519 && ed25519.Verify(key, message, signature)
+	}
+	return false
+}
+
+// Sign signs the MD5 of message. Use SignWith for new messages.
 func Sign(message []byte, privKey *ecdsa.PrivateKey) (string, error) {
 	var h hash.Hash
 	h = md5.New()
@@ -80,6 +185,7 @@ func Sign(message []byte, privKey *ecdsa.PrivateKey) (string, error) {
 	return hex.EncodeToString(signature), nil
 }
 
+// Verify checks a signature made by Sign.
 func Verify(message []byte, sign string, pubKey *ecdsa.PublicKey) bool {
 	var h hash.Hash
 	h = md5.New()